@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Scope is a permission an API key can be given
+type Scope string
+
+const (
+	// Reading orders and the archive
+	ScopeRead Scope = "orders:read"
+	// Creating, changing, cancelling, completing and restoring orders
+	ScopeWrite Scope = "orders:write"
+	// Purging orders. Includes the other scopes
+	ScopeAdmin Scope = "orders:admin"
+)
+
+var allScopes = []Scope{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// Start of every API key, so leaked keys are easy to spot
+const apiKeyPrefix = "oa_"
+
+// APIKey is a saved API key. Only a hash of the secret part is kept, the key itself is
+// shown once when it is created
+type APIKey struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+	// Hex encoded SHA-256 of the key's secret
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Reports whether the key grants scope. The admin scope grants every other scope
+func (k APIKey) allows(scope Scope) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// Returned when there is no key with the given ID
+var errAPIKeyNotFound = errors.New("API key not found")
+
+// Returned when revoking a key that is already revoked
+var errAPIKeyRevoked = errors.New("API key already revoked")
+
+// Parses a comma separated list of scopes
+func parseScopes(list string) ([]Scope, error) {
+	var scopes []Scope
+
+	for _, name := range strings.Split(list, ",") {
+		scope := Scope(strings.TrimSpace(name))
+
+		if !slices.Contains(allScopes, scope) {
+			return nil, fmt.Errorf("unknown scope '%s'", scope)
+		}
+
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes, nil
+}
+
+// Hashes the secret part of a key for storing and comparing
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// KeyStore holds the API keys saved in a JSON file. The file is read again whenever it
+// changes so keys created or revoked from the command line apply to a running server
+type KeyStore struct {
+	path string
+	now  func() time.Time
+
+	mu   sync.Mutex
+	keys []APIKey
+	// Modification time and size of the file when it was last read
+	modTime time.Time
+	size    int64
+}
+
+// Opens the API keys saved at path, creating the file when the first key is created
+func NewKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path, now: time.Now}
+
+	if err := recoverDatabase(path); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reads the file again if it has changed since it was last read. The caller must hold mu
+func (s *KeyStore) reload() error {
+	info, err := os.Stat(s.path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys = nil
+		s.modTime = time.Time{}
+		s.size = 0
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+
+	if err != nil {
+		return err
+	}
+
+	var keys []APIKey
+
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	return nil
+}
+
+// Writes the keys to the file. The caller must hold mu
+func (s *KeyStore) save() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+
+	// The keys in memory are already up to date, so don't read the file straight back in
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+	}
+
+	return nil
+}
+
+// Creates a key with the given name and scopes. Returns the key to hand to the client,
+// which can't be recovered later, along with its saved record
+func (s *KeyStore) Create(name string, scopes []Scope) (string, APIKey, error) {
+	if len(scopes) == 0 {
+		return "", APIKey{}, errors.New("an API key needs at least one scope")
+	}
+
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", APIKey{}, err
+	}
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+
+	key := APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashSecret(hex.EncodeToString(secret)),
+		CreatedAt: s.now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return "", APIKey{}, err
+	}
+
+	s.keys = append(s.keys, key)
+
+	if err := s.save(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return "", APIKey{}, err
+	}
+
+	return apiKeyPrefix + key.ID + "_" + hex.EncodeToString(secret), key, nil
+}
+
+// Returns every key, including revoked ones, oldest first
+func (s *KeyStore) List() ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return slices.Clone(s.keys), nil
+}
+
+// Revokes the key with the given ID. Revoked keys stay in the file so it is clear who
+// had access, but can no longer be used
+func (s *KeyStore) Revoke(id string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return APIKey{}, err
+	}
+
+	i := slices.IndexFunc(s.keys, func(key APIKey) bool { return key.ID == id })
+
+	if i < 0 {
+		return APIKey{}, errAPIKeyNotFound
+	}
+
+	if s.keys[i].RevokedAt != nil {
+		return s.keys[i], errAPIKeyRevoked
+	}
+
+	now := s.now().UTC()
+	s.keys[i].RevokedAt = &now
+
+	if err := s.save(); err != nil {
+		s.keys[i].RevokedAt = nil
+		return APIKey{}, err
+	}
+
+	return s.keys[i], nil
+}
+
+// Reports whether no key has been created yet. Revoked keys count, so revoking every key
+// doesn't open up a server that relied on them
+func (s *KeyStore) Empty() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return false, err
+	}
+
+	return len(s.keys) == 0, nil
+}
+
+// Looks up the key a client sent. Returns false if it isn't a key, is unknown or
+// has been revoked
+func (s *KeyStore) Authenticate(token string) (APIKey, bool, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+
+	if !ok || !strings.HasPrefix(token, apiKeyPrefix) {
+		return APIKey{}, false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return APIKey{}, false, err
+	}
+
+	hash := hashSecret(secret)
+
+	for _, key := range s.keys {
+		if key.ID != id {
+			continue
+		}
+
+		if key.RevokedAt != nil || subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) != 1 {
+			return APIKey{}, false, nil
+		}
+
+		return key, true, nil
+	}
+
+	return APIKey{}, false, nil
+}
+
+// Usage of the keys command
+const keysUsage = `Usage: order-api keys <command> [flags]
+
+Commands:
+  create -name <name> -scopes <scopes>   create a key and print it
+  list                                   list every key
+  revoke <id>                            revoke a key
+
+Scopes are a comma separated list of orders:read, orders:write and orders:admin.
+The key file is the api-keys setting, which -config and -api-keys can also set.
+Flags can go before or after the key ID.
+`
+
+// Runs the keys command, which manages the API keys in the file the server reads them from.
+// args are the arguments after "keys"
+func keysCommand(args []string, getenv func(string) string, stdout io.Writer, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, keysUsage)
+		return errors.New("missing keys command")
+	}
+
+	fs := flag.NewFlagSet("order-api keys "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	configPath := fs.String("config", "", "path of a YAML config file")
+	keysPath := fs.String("api-keys", "", "path of the API key file")
+
+	var name, scopes *string
+
+	switch args[0] {
+	case "create":
+		name = fs.String("name", "", "name of the new key, such as who or what it is for")
+		scopes = fs.String("scopes", "", "comma separated scopes of the new key")
+	case "list", "revoke":
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stderr, keysUsage)
+		return flag.ErrHelp
+	default:
+		fmt.Fprint(stderr, keysUsage)
+		return fmt.Errorf("unknown keys command '%s'", args[0])
+	}
+
+	// Flags can come after the key ID as well as before it, so carry on parsing past each
+	// argument that isn't a flag
+	var positional []string
+
+	rest := args[1:]
+
+	for {
+		if err := fs.Parse(rest); err != nil {
+			return err
+		}
+
+		if fs.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+
+	if args[0] != "revoke" && len(positional) > 0 {
+		return fmt.Errorf("unexpected argument '%s'", positional[0])
+	}
+
+	// Find the key file the same way the server does
+	var configArgs []string
+
+	if *configPath != "" {
+		configArgs = append(configArgs, "-config", *configPath)
+	}
+
+	if *keysPath != "" {
+		configArgs = append(configArgs, "-api-keys", *keysPath)
+	}
+
+	config, _, err := loadConfig(configArgs, getenv, stderr)
+
+	if err != nil {
+		return err
+	}
+
+	if config.APIKeys == "" {
+		return errors.New("no API key file is configured, set api-keys")
+	}
+
+	store, err := NewKeyStore(config.APIKeys)
+
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+
+		parsed, err := parseScopes(*scopes)
+
+		if err != nil {
+			return err
+		}
+
+		token, key, err := store.Create(*name, parsed)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(stderr, "Created key %s. It won't be shown again:\n", key.ID)
+		fmt.Fprintln(stdout, token)
+	case "list":
+		keys, err := store.List()
+
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tREVOKED")
+
+		for _, key := range keys {
+			revoked := "-"
+
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+
+			scopes := make([]string, len(key.Scopes))
+
+			for i, scope := range key.Scopes {
+				scopes[i] = string(scope)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(scopes, ","), key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+
+		return w.Flush()
+	case "revoke":
+		if len(positional) != 1 {
+			return errors.New("revoke takes the ID of one key")
+		}
+
+		key, err := store.Revoke(positional[0])
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(stdout, "Revoked key %s (%s)\n", key.ID, key.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// Opens a key store backed by a file in a temporary directory
+func newTestKeyStore(t *testing.T) *KeyStore {
+	store, err := NewKeyStore(filepath.Join(t.TempDir(), "api-keys.json"))
+
+	if err != nil {
+		panic(err)
+	}
+
+	return store
+}
+
+func TestKeyStore(t *testing.T) {
+	store := newTestKeyStore(t)
+
+	token, key, err := store.Create("warehouse", []Scope{ScopeRead})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(token, apiKeyPrefix+key.ID+"_"), true)
+
+	found, ok, err := store.Authenticate(token)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, found.Name, "warehouse")
+	assert.Equal(t, found.allows(ScopeRead), true)
+	assert.Equal(t, found.allows(ScopeWrite), false)
+
+	// Only the hash of the key is saved
+	data, err := os.ReadFile(store.path)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(string(data), strings.TrimPrefix(token, apiKeyPrefix+key.ID+"_")), false)
+
+	// Keys with the wrong secret or an unknown ID are rejected
+	for _, bad := range []string{token + "0", apiKeyPrefix + "000000000000_00", "not-a-key", ""} {
+		_, ok, err := store.Authenticate(bad)
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ok, false)
+	}
+
+	revoked, err := store.Revoke(key.ID)
+
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, revoked.RevokedAt, nil)
+
+	_, ok, _ = store.Authenticate(token)
+
+	assert.Equal(t, ok, false)
+
+	_, err = store.Revoke(key.ID)
+
+	assert.Equal(t, err, errAPIKeyRevoked)
+
+	_, err = store.Revoke("missing")
+
+	assert.Equal(t, err, errAPIKeyNotFound)
+
+	// Revoked keys are still listed
+	keys, err := store.List()
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 1)
+
+	_, _, err = store.Create("empty", nil)
+
+	assert.NotEqual(t, err, nil)
+}
+
+func TestKeyStoreReloads(t *testing.T) {
+	server := newTestKeyStore(t)
+	cli, err := NewKeyStore(server.path)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Keys created and revoked by another process apply straight away
+	token, key, err := cli.Create("ci", []Scope{ScopeAdmin})
+
+	assert.Equal(t, err, nil)
+
+	found, ok, err := server.Authenticate(token)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, found.allows(ScopeWrite), true)
+
+	_, err = cli.Revoke(key.ID)
+
+	assert.Equal(t, err, nil)
+
+	_, ok, _ = server.Authenticate(token)
+
+	assert.Equal(t, ok, false)
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes("orders:read, orders:write,orders:read")
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, scopes, []Scope{ScopeRead, ScopeWrite})
+
+	_, err = parseScopes("orders:delete")
+
+	assert.Equal(t, err.Error(), "unknown scope 'orders:delete'")
+
+	_, err = parseScopes("")
+
+	assert.NotEqual(t, err, nil)
+}
+
+func TestKeysCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	env := fakeEnv(map[string]string{"ORDER_API_API_KEYS": path})
+
+	var stdout, stderr bytes.Buffer
+
+	err := keysCommand([]string{"create", "-name", "warehouse", "-scopes", "orders:read,orders:write"}, env, &stdout, &stderr)
+
+	assert.Equal(t, err, nil)
+
+	token := strings.TrimSpace(stdout.String())
+	store, err := NewKeyStore(path)
+
+	if err != nil {
+		panic(err)
+	}
+
+	key, ok, _ := store.Authenticate(token)
+
+	assert.Equal(t, ok, true)
+	assert.Equal(t, key.Scopes, []Scope{ScopeRead, ScopeWrite})
+
+	stdout.Reset()
+
+	assert.Equal(t, keysCommand([]string{"list"}, env, &stdout, &stderr), nil)
+	assert.Equal(t, strings.Contains(stdout.String(), key.ID+"  warehouse  orders:read,orders:write"), true)
+
+	stdout.Reset()
+
+	assert.Equal(t, keysCommand([]string{"revoke", key.ID}, env, &stdout, &stderr), nil)
+	assert.Equal(t, stdout.String(), "Revoked key "+key.ID+" (warehouse)\n")
+
+	// -api-keys overrides the environment
+	other := filepath.Join(t.TempDir(), "other.json")
+
+	assert.Equal(t, keysCommand([]string{"create", "-api-keys", other, "-name", "ci", "-scopes", "orders:admin"}, env, &stdout, &stderr), nil)
+
+	var saved []APIKey
+
+	data, err := os.ReadFile(other)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, json.Unmarshal(data, &saved), nil)
+	assert.Equal(t, saved[0].Name, "ci")
+
+	// Flags after the key ID are parsed too
+	stdout.Reset()
+
+	assert.Equal(t, keysCommand([]string{"revoke", saved[0].ID, "-api-keys", other}, env, &stdout, &stderr), nil)
+	assert.Equal(t, stdout.String(), "Revoked key "+saved[0].ID+" (ci)\n")
+
+	tests := []struct {
+		name    string
+		args    []string
+		message string
+	}{
+		{"NoCommand", nil, "missing keys command"},
+		{"UnknownCommand", []string{"rotate"}, "unknown keys command 'rotate'"},
+		{"MissingName", []string{"create", "-scopes", "orders:read"}, "-name is required"},
+		{"BadScope", []string{"create", "-name", "x", "-scopes", "orders:all"}, "unknown scope 'orders:all'"},
+		{"RevokeWithoutID", []string{"revoke"}, "revoke takes the ID of one key"},
+		{"RevokeTwoIDs", []string{"revoke", "a", "-api-keys", path, "b"}, "revoke takes the ID of one key"},
+		{"RevokeUnknown", []string{"revoke", "missing"}, "API key not found"},
+		{"ExtraArgument", []string{"list", "all"}, "unexpected argument 'all'"},
+		{"ExtraArgumentBeforeFlag", []string{"list", "all", "-api-keys", path}, "unexpected argument 'all'"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := keysCommand(test.args, env, &stdout, &stderr)
+
+			assert.NotEqual(t, err, nil)
+			assert.Equal(t, err.Error(), test.message)
+		})
+	}
+}
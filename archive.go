@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Returns the path of the archive kept next to the database at path, e.g. orders.archive.json for orders.json
+func archivePath(path string) string {
+	ext := filepath.Ext(path)
+
+	return strings.TrimSuffix(path, ext) + ".archive" + ext
+}
+
+// Returns the URL of an archived order
+func archivedOrderLocation(id string) string {
+	return "/v1/archive/orders/" + url.PathEscape(id)
+}
+
+// Reports whether an order is finished with and belongs in the archive
+func (o Order) completed() bool {
+	return !o.Active && o.OrderStatus == OrderShipped
+}
+
+// Returned when archiving an order whose ID belongs to a different order in the archive
+var errArchivedOrderExists = errors.New("a different order with the same ID is already archived")
+
+// Moves an order from the active store into the archive. The order is written to the archive
+// before it is removed from the active store so a failure part way leaves it in both rather
+// than neither. A copy left in the archive by an earlier failed move is overwritten, but a
+// different order that happens to have the same ID is left alone
+func (api *API) archiveOrder(ctx context.Context, order Order) error {
+	archive := api.archived(ctx)
+
+	err := archive.Create(order)
+
+	if errors.Is(err, ErrOrderExists) {
+		_, err = archive.Update(order.ID, func(archived *Order) error {
+			if !archived.CreatedAt.Equal(order.CreatedAt) {
+				return errArchivedOrderExists
+			}
+
+			*archived = order
+			return nil
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Only remove the order if nobody changed it while it was being copied
+	_, err = api.orders(ctx).Delete(order.ID, func(current Order) error {
+		if current.Version != order.Version {
+			return errPreconditionFailed
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// Moves every completed order still in the active store into the archive. Orders completed
+// before there was an archive, or whose move failed part way, are picked up here
+func (api *API) archiveCompleted() (int, error) {
+	orders, err := api.store.List()
+
+	if err != nil {
+		return 0, err
+	}
+
+	archived := 0
+
+	for _, order := range orders {
+		if !order.completed() {
+			continue
+		}
+
+		err := api.archiveOrder(context.Background(), order)
+
+		if errors.Is(err, errArchivedOrderExists) {
+			slog.Warn("Leaving completed order in the active store", "orderId", order.ID, "error", err)
+			continue
+		}
+
+		if err != nil {
+			return archived, err
+		}
+
+		archived++
+	}
+
+	return archived, nil
+}
+
+// ListArchivedOrders godoc
+//
+// @Summary Lists archived orders
+// @Security ApiKey
+// @Description Completed orders are moved out of the active set into the archive. This takes the same filters, sorting
+// @Description and paging as listing active orders
+// @Param   status          query   []Status    false   "Only orders in these statuses"    collectionFormat(csv)
+// @Param   active          query   bool        false   "Only active or inactive orders"
+// @Param   recipient       query   string      false   "Only orders for this recipient"
+// @Param   address         query   string      false   "Only orders whose address contains this text"
+// @Param   createdAfter    query   string      false   "Only orders created at or after this RFC 3339 time"
+// @Param   createdBefore   query   string      false   "Only orders created before this RFC 3339 time"
+// @Param   sort            query   string      false   "Field to sort by, prefixed with - for descending order" Enums(id, createdAt, orderStatus, active, recipient, address, -id, -createdAt, -orderStatus, -active, -recipient, -address)
+// @Param   limit           query   int         false   "Maximum number of orders to return (1-200, default 50)"
+// @Param   cursor          query   string      false   "Cursor from the previous page"
+// @Schemes http https
+// @Produce json
+// @Success 200 {object} OrderPage
+// @Failure 400 {object} Problem "Description of the invalid parameter"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:read scope"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/archive/orders [get]
+func (api *API) listArchivedOrders(c *gin.Context) {
+	query, err := parseOrderQuery(c.Request.URL.Query())
+
+	if err != nil {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidQuery, err.Error()))
+		return
+	}
+
+	orders, err := findOrders(api.archived(c.Request.Context()), query)
+
+	if err != nil {
+		writeError(c, "", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, query.apply(orders))
+}
+
+// GetArchivedOrder godoc
+//
+// @Summary Gets an archived order
+// @Security ApiKey
+// @Param   id  path    string true "Order ID"
+// @Schemes http https
+// @Produce json
+// @Success 200 {object} Order
+// @Header  200 {string} ETag "Version of the order"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:read scope"
+// @Failure 404 {object} Problem "Order with ID 'X' not found"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/archive/orders/{id} [get]
+func (api *API) getArchivedOrder(c *gin.Context) {
+	id := orderID(c)
+
+	order, err := api.archived(c.Request.Context()).Get(id)
+
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	writeOrder(c, http.StatusOK, order)
+}
+
+// RestoreOrder godoc
+//
+// @Summary Moves an archived order back into the active orders
+// @Security ApiKey
+// @Description The order is reactivated so it can be changed again, e.g. to mark it as returned
+// @Param   id          path    string  true    "Order ID"
+// @Param   If-Match    header  string  false   "ETag the archived order must still have"
+// @Schemes http https
+// @Produce json
+// @Success 200 {object} Order
+// @Header  200 {string} Location "URL of the restored order"
+// @Header  200 {string} ETag "Version of the order after the change"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:write scope"
+// @Failure 404 {object} Problem "Order with ID 'X' not found"
+// @Failure 409 {object} Problem "An active order with the same ID already exists"
+// @Failure 412 {object} Problem "Order has changed since the ETag in If-Match was read"
+// @Failure 428 {object} Problem "If-Match header is required"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/archive/orders/{id}/restore [post]
+func (api *API) restoreOrder(c *gin.Context) {
+	id := orderID(c)
+
+	check, err := api.ifMatch(c)
+
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	order, err := api.archived(c.Request.Context()).Get(id)
+
+	if err == nil {
+		err = check(order)
+	}
+
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	order.Active = true
+	order.UpdatedAt = api.now().UTC()
+	order.Version++
+
+	if err := api.orders(c.Request.Context()).Create(order); err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	if _, err := api.archived(c.Request.Context()).Delete(id, nil); err != nil {
+		// The order is active again, the stale archive copy is overwritten if it is archived again
+		api.log(c).Error("Failed to remove restored order from the archive", "orderId", id, "error", err)
+	}
+
+	api.log(c).Info("Order restored", "orderId", id, "version", order.Version)
+
+	c.Header("Location", orderLocation(id))
+	writeOrder(c, http.StatusOK, order)
+}
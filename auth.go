@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header API keys can be sent in instead of Authorization
+const apiKeyHeader = "X-API-Key"
+
+// Key the client a request was authenticated as is kept under in the gin context
+const clientKey = "client"
+
+// Returns who made a request: "key:" and the ID of the API key it sent, "admin" for the admin
+// token or "anonymous" for a request without a credential
+func client(c *gin.Context) string {
+	if client := c.GetString(clientKey); client != "" {
+		return client
+	}
+
+	return "anonymous"
+}
+
+// Returns the credential a request was sent with, from either an Authorization bearer
+// token or the X-API-Key header
+func credential(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return token
+	}
+
+	return c.GetHeader(apiKeyHeader)
+}
+
+// Rejects a request that didn't authenticate
+func unauthorized(c *gin.Context, detail string) {
+	c.Header("WWW-Authenticate", `Bearer realm="order-api"`)
+	writeProblem(c, newProblem(http.StatusUnauthorized, codeUnauthorized, detail))
+}
+
+// Reports whether a request without a credential can use a route that needs scope. Only read
+// and write routes are ever open, and only while API keys aren't required and none have been
+// created, so leaving a key out can never get a client more than sending one
+func (api *API) anonymousAllowed(scope Scope) (bool, error) {
+	if scope == ScopeAdmin || api.requireAPIKey {
+		return false, nil
+	}
+
+	if api.keys == nil {
+		return true, nil
+	}
+
+	return api.keys.Empty()
+}
+
+// Middleware that only lets through requests made with an API key that has scope, or with
+// the admin token, which has every scope. Admin routes are turned off altogether when there
+// is neither an admin token nor an API key file
+func (api *API) requireScope(scope Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if scope == ScopeAdmin && api.adminToken == "" && api.keys == nil {
+			writeProblem(c, newProblem(http.StatusForbidden, codeForbidden, "Admin routes are disabled because no admin token or API keys are configured"))
+			return
+		}
+
+		token := credential(c)
+
+		if token == "" {
+			allowed, err := api.anonymousAllowed(scope)
+
+			if err != nil {
+				api.log(c).Error("Failed to read API keys", "error", err)
+				writeProblem(c, newProblem(http.StatusInternalServerError, codeStorageFailure, "Failed to check the API key"))
+				return
+			}
+
+			if allowed {
+				c.Next()
+				return
+			}
+
+			unauthorized(c, "An API key with the "+string(scope)+" scope is required")
+			return
+		}
+
+		if api.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) == 1 {
+			c.Set(clientKey, "admin")
+			c.Next()
+			return
+		}
+
+		if api.keys == nil {
+			unauthorized(c, "The API key is invalid")
+			return
+		}
+
+		key, ok, err := api.keys.Authenticate(token)
+
+		if err != nil {
+			api.log(c).Error("Failed to read API keys", "error", err)
+			writeProblem(c, newProblem(http.StatusInternalServerError, codeStorageFailure, "Failed to check the API key"))
+			return
+		}
+
+		if !ok {
+			unauthorized(c, "The API key is invalid or has been revoked")
+			return
+		}
+
+		if !key.allows(scope) {
+			writeProblem(c, newProblem(http.StatusForbidden, codeForbidden, "The API key doesn't have the "+string(scope)+" scope"))
+			return
+		}
+
+		// Tie the rest of the request's log lines to the key that made it
+		c.Set(clientKey, "key:"+key.ID)
+		c.Set(loggerKey, api.log(c).With("apiKey", key.ID))
+		c.Next()
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables the server reads its settings from
+const envPrefix = "ORDER_API_"
+
+// Duration is a time.Duration written as a string like "30s" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// Config holds every setting of the server. Each setting has one name used for its flag,
+// its key in the config file and, upper cased with dashes turned into underscores and
+// ORDER_API_ in front, its environment variable. Settings are taken from, in increasing
+// order of precedence, the defaults, the config file, the environment and the flags
+type Config struct {
+	Listen       string   `yaml:"listen"`
+	ReadTimeout  Duration `yaml:"read-timeout"`
+	WriteTimeout Duration `yaml:"write-timeout"`
+	IdleTimeout  Duration `yaml:"idle-timeout"`
+	// How long shutdown waits for requests that are still being handled
+	ShutdownTimeout Duration `yaml:"shutdown-timeout"`
+	LogLevel        string   `yaml:"log-level"`
+	LogFormat       string   `yaml:"log-format"`
+
+	Storage         string `yaml:"storage"`
+	DB              string `yaml:"db"`
+	ArchiveDB       string `yaml:"archive-db"`
+	JournalMaxBytes int64  `yaml:"journal-max-bytes"`
+
+	IDFormat       string   `yaml:"id-format"`
+	IdempotencyDB  string   `yaml:"idempotency-db"`
+	IdempotencyTTL Duration `yaml:"idempotency-ttl"`
+	RequireIfMatch bool     `yaml:"require-if-match"`
+	AdminToken     string   `yaml:"admin-token"`
+	APIKeys        string   `yaml:"api-keys"`
+	RequireAPIKey  bool     `yaml:"require-api-key"`
+
+	Swagger     bool   `yaml:"swagger"`
+	SwaggerFile string `yaml:"swagger-file"`
+	Metrics     bool   `yaml:"metrics"`
+
+	TracingExporter    string  `yaml:"tracing-exporter"`
+	TracingEndpoint    string  `yaml:"tracing-endpoint"`
+	TracingFile        string  `yaml:"tracing-file"`
+	TracingSampleRatio float64 `yaml:"tracing-sample-ratio"`
+}
+
+// Returns the settings used when nothing else is given
+func defaultConfig() Config {
+	return Config{
+		Listen:          "localhost:6969",
+		ReadTimeout:     Duration(10 * time.Second),
+		WriteTimeout:    Duration(30 * time.Second),
+		IdleTimeout:     Duration(2 * time.Minute),
+		ShutdownTimeout: Duration(15 * time.Second),
+		LogLevel:        "info",
+		LogFormat:       "text",
+
+		Storage:         "json",
+		JournalMaxBytes: 1 << 20,
+
+		IDFormat:       "uuidv7",
+		IdempotencyDB:  "idempotency.json",
+		IdempotencyTTL: Duration(24 * time.Hour),
+		APIKeys:        "api-keys.json",
+		RequireAPIKey:  true,
+
+		Swagger:     true,
+		SwaggerFile: "docs/swagger.json",
+		Metrics:     true,
+
+		TracingExporter:    "none",
+		TracingSampleRatio: 1,
+	}
+}
+
+// Registers a flag for every setting in c. The flags write straight into c
+func (c *Config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address the server listens on")
+	fs.DurationVar((*time.Duration)(&c.ReadTimeout), "read-timeout", time.Duration(c.ReadTimeout), "longest a client can take to send a request")
+	fs.DurationVar((*time.Duration)(&c.WriteTimeout), "write-timeout", time.Duration(c.WriteTimeout), "longest the server can take to write a response")
+	fs.DurationVar((*time.Duration)(&c.IdleTimeout), "idle-timeout", time.Duration(c.IdleTimeout), "how long idle keep-alive connections are kept open")
+	fs.DurationVar((*time.Duration)(&c.ShutdownTimeout), "shutdown-timeout", time.Duration(c.ShutdownTimeout), "how long to wait for requests to finish when shutting down")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of messages to log (debug, info, warn or error)")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format of log messages (text or json)")
+
+	fs.StringVar(&c.Storage, "storage", c.Storage, "storage backend to use (json or sqlite)")
+	fs.StringVar(&c.DB, "db", c.DB, "path of the database file (defaults to orders.json or orders.db)")
+	fs.StringVar(&c.ArchiveDB, "archive-db", c.ArchiveDB, "path of the database completed orders are archived in (defaults to the database path with .archive before the extension)")
+	fs.Int64Var(&c.JournalMaxBytes, "journal-max-bytes", c.JournalMaxBytes, "size the JSON journal can reach before it is compacted into the database file")
+
+	fs.StringVar(&c.IDFormat, "id-format", c.IDFormat, "format of generated order IDs (uuidv7, ulid or sequence)")
+	fs.StringVar(&c.IdempotencyDB, "idempotency-db", c.IdempotencyDB, "path of the file idempotency keys are saved in")
+	fs.DurationVar((*time.Duration)(&c.IdempotencyTTL), "idempotency-ttl", time.Duration(c.IdempotencyTTL), "how long idempotency keys are remembered")
+	fs.BoolVar(&c.RequireIfMatch, "require-if-match", c.RequireIfMatch, "reject changes to orders that don't send an If-Match header")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token with every scope, including the admin routes such as purging orders")
+	fs.StringVar(&c.APIKeys, "api-keys", c.APIKeys, "path of the file API keys are saved in (API keys are disabled when empty)")
+	fs.BoolVar(&c.RequireAPIKey, "require-api-key", c.RequireAPIKey, "reject requests to read or change orders that don't send an API key, even before any key has been created")
+
+	fs.BoolVar(&c.Swagger, "swagger", c.Swagger, "serve the Swagger UI and spec")
+	fs.StringVar(&c.SwaggerFile, "swagger-file", c.SwaggerFile, "path of the Swagger spec to serve")
+	fs.BoolVar(&c.Metrics, "metrics", c.Metrics, "serve Prometheus metrics on /metrics")
+
+	fs.StringVar(&c.TracingExporter, "tracing-exporter", c.TracingExporter, "where to send traces (none, otlp or stdout)")
+	fs.StringVar(&c.TracingEndpoint, "tracing-endpoint", c.TracingEndpoint, "URL of the OTLP/HTTP collector traces are sent to (defaults to the OTEL_EXPORTER_OTLP_* variables)")
+	fs.StringVar(&c.TracingFile, "tracing-file", c.TracingFile, "file the stdout exporter appends traces to instead of stdout")
+	fs.Float64Var(&c.TracingSampleRatio, "tracing-sample-ratio", c.TracingSampleRatio, "share of new traces to record, from 0 to 1")
+}
+
+// Returns the environment variable a setting is read from
+func envName(setting string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// Builds the config from the command line arguments (without the program name), the
+// environment and the config file named by -config or ORDER_API_CONFIG. Also reports
+// whether -print-config was given
+func loadConfig(args []string, getenv func(string) string, output io.Writer) (Config, bool, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("order-api", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	c.flags(fs)
+
+	configPath := fs.String("config", getenv(envName("config")), "path of a YAML config file")
+	printConfig := fs.Bool("print-config", false, "print the config the server would run with and exit")
+
+	if err := fs.Parse(args); err != nil {
+		return c, false, err
+	}
+
+	if fs.NArg() > 0 {
+		return c, false, fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+	}
+
+	// The flags have been parsed to find the config file, but they need to be applied
+	// again on top of it and the environment
+	explicit := map[string]string{}
+
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	c = defaultConfig()
+
+	if *configPath != "" {
+		if err := c.readFile(*configPath); err != nil {
+			return c, false, err
+		}
+	}
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" || err != nil {
+			return
+		}
+
+		if value, ok := explicit[f.Name]; ok {
+			err = fs.Set(f.Name, value)
+		} else if value := getenv(envName(f.Name)); value != "" {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+			}
+		}
+	})
+
+	if err != nil {
+		return c, false, err
+	}
+
+	return c, *printConfig, c.validate()
+}
+
+// Reads settings from a YAML file over the ones already in c
+func (c *Config) readFile(path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Checks that every setting has a usable value
+func (c Config) validate() error {
+	var problems []string
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen: %v", err))
+	}
+
+	if c.ReadTimeout < 0 {
+		problems = append(problems, "read-timeout: can't be negative")
+	}
+
+	if c.WriteTimeout < 0 {
+		problems = append(problems, "write-timeout: can't be negative")
+	}
+
+	if c.IdleTimeout < 0 {
+		problems = append(problems, "idle-timeout: can't be negative")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown-timeout: must be positive")
+	}
+
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("log-level: unknown level '%s'", c.LogLevel))
+	}
+
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		problems = append(problems, fmt.Sprintf("log-format: unknown format '%s'", c.LogFormat))
+	}
+
+	if _, ok := defaultDatabasePaths[c.Storage]; !ok {
+		problems = append(problems, fmt.Sprintf("storage: unknown storage backend '%s'", c.Storage))
+	}
+
+	if c.JournalMaxBytes < 0 {
+		problems = append(problems, "journal-max-bytes: can't be negative")
+	}
+
+	switch c.IDFormat {
+	case "uuidv7", "ulid", "sequence":
+	default:
+		problems = append(problems, fmt.Sprintf("id-format: unknown ID format '%s'", c.IDFormat))
+	}
+
+	if c.IdempotencyDB == "" {
+		problems = append(problems, "idempotency-db: is required")
+	}
+
+	if c.IdempotencyTTL <= 0 {
+		problems = append(problems, "idempotency-ttl: must be positive")
+	}
+
+	if c.RequireAPIKey && c.APIKeys == "" && c.AdminToken == "" {
+		problems = append(problems, "require-api-key: needs api-keys or admin-token to be set")
+	}
+
+	switch c.TracingExporter {
+	case "none", "otlp", "stdout":
+	default:
+		problems = append(problems, fmt.Sprintf("tracing-exporter: unknown exporter '%s'", c.TracingExporter))
+	}
+
+	if c.TracingEndpoint != "" {
+		if u, err := url.Parse(c.TracingEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("tracing-endpoint: '%s' isn't an absolute URL", c.TracingEndpoint))
+		}
+	}
+
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		problems = append(problems, "tracing-sample-ratio: must be between 0 and 1")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// Fills in the database paths that default to ones based on other settings
+func (c *Config) resolvePaths() {
+	if c.DB == "" {
+		c.DB = defaultDatabasePaths[c.Storage]
+	}
+
+	if c.ArchiveDB == "" {
+		c.ArchiveDB = archivePath(c.DB)
+	}
+}
+
+// Writes the config as YAML with secrets hidden
+func (c Config) print(w io.Writer) error {
+	if c.AdminToken != "" {
+		c.AdminToken = "REDACTED"
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// Returns a getenv function that reads from the given variables instead of the environment
+func fakeEnv(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+// Writes a config file in a temporary directory and returns its path
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		panic(err)
+	}
+
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config, printConfig, err := loadConfig(nil, fakeEnv(nil), &bytes.Buffer{})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, printConfig, false)
+	assert.Equal(t, config, defaultConfig())
+	assert.Equal(t, config.RequireAPIKey, true)
+
+	config.resolvePaths()
+
+	assert.Equal(t, config.DB, "orders.json")
+	assert.Equal(t, config.ArchiveDB, "orders.archive.json")
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+listen: 0.0.0.0:8000
+storage: sqlite
+log-level: warn
+read-timeout: 5s
+swagger: false
+`)
+
+	env := fakeEnv(map[string]string{
+		"ORDER_API_CONFIG":      path,
+		"ORDER_API_LISTEN":      "0.0.0.0:9000",
+		"ORDER_API_LOG_LEVEL":   "error",
+		"ORDER_API_ADMIN_TOKEN": "secret",
+	})
+
+	config, _, err := loadConfig([]string{"-log-level", "debug"}, env, &bytes.Buffer{})
+
+	assert.Equal(t, err, nil)
+
+	// The file overrides the defaults
+	assert.Equal(t, config.Storage, "sqlite")
+	assert.Equal(t, config.ReadTimeout, Duration(5*time.Second))
+	assert.Equal(t, config.Swagger, false)
+
+	// The environment overrides the file
+	assert.Equal(t, config.Listen, "0.0.0.0:9000")
+	assert.Equal(t, config.AdminToken, "secret")
+
+	// Flags override everything
+	assert.Equal(t, config.LogLevel, "debug")
+
+	// Settings nobody set keep their defaults
+	assert.Equal(t, config.IDFormat, "uuidv7")
+
+	config.resolvePaths()
+
+	assert.Equal(t, config.DB, "orders.db")
+	assert.Equal(t, config.ArchiveDB, "orders.archive.db")
+}
+
+func TestConfigFileFlag(t *testing.T) {
+	path := writeConfigFile(t, "id-format: ulid\n")
+
+	config, _, err := loadConfig([]string{"-config", path}, fakeEnv(nil), &bytes.Buffer{})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, config.IDFormat, "ulid")
+
+	// An empty file changes nothing
+	path = writeConfigFile(t, "")
+
+	config, _, err = loadConfig([]string{"-config", path}, fakeEnv(nil), &bytes.Buffer{})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, config, defaultConfig())
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		file    string
+		message string
+	}{
+		{"UnknownFlag", []string{"-nope"}, nil, "", "flag provided but not defined"},
+		{"ExtraArgument", []string{"serve"}, nil, "", "unexpected argument 'serve'"},
+		{"BadEnvironment", nil, map[string]string{"ORDER_API_IDEMPOTENCY_TTL": "soon"}, "", "ORDER_API_IDEMPOTENCY_TTL"},
+		{"UnknownKey", nil, nil, "colour: blue\n", "field colour not found"},
+		{"BadDuration", nil, nil, "idle-timeout: forever\n", "line 1"},
+		{"BadListen", []string{"-listen", "localhost"}, nil, "", "listen:"},
+		{"BadStorage", []string{"-storage", "csv"}, nil, "", "storage: unknown storage backend 'csv'"},
+		{"BadLogFormat", []string{"-log-format", "xml"}, nil, "", "log-format: unknown format 'xml'"},
+		{"BadLogLevel", nil, map[string]string{"ORDER_API_LOG_LEVEL": "loud"}, "", "log-level: unknown level 'loud'"},
+		{"BadTracingExporter", []string{"-tracing-exporter", "jaeger"}, nil, "", "tracing-exporter: unknown exporter 'jaeger'"},
+		{"BadTracingEndpoint", []string{"-tracing-endpoint", "localhost:4318"}, nil, "", "tracing-endpoint: 'localhost:4318' isn't an absolute URL"},
+		{"BadTracingSampleRatio", nil, map[string]string{"ORDER_API_TRACING_SAMPLE_RATIO": "1.5"}, "", "tracing-sample-ratio: must be between 0 and 1"},
+		{"BadIDFormat", []string{"-id-format", "uuidv4"}, nil, "", "id-format: unknown ID format 'uuidv4'"},
+		{"NegativeTimeout", []string{"-write-timeout", "-1s"}, nil, "", "write-timeout: can't be negative"},
+		{"RequireAPIKeyWithoutKeys", []string{"-require-api-key", "-api-keys", ""}, nil, "", "require-api-key: needs api-keys or admin-token to be set"},
+		{"ZeroIdempotencyTTL", []string{"-idempotency-ttl", "0s"}, nil, "", "idempotency-ttl: must be positive"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := test.args
+
+			if test.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, test.file)}, args...)
+			}
+
+			_, _, err := loadConfig(args, fakeEnv(test.env), &bytes.Buffer{})
+
+			assert.NotEqual(t, err, nil)
+			assert.Equal(t, strings.Contains(err.Error(), test.message), true)
+		})
+	}
+
+	// Every invalid setting is reported at once
+	_, _, err := loadConfig([]string{"-storage", "csv", "-id-format", "uuidv4"}, fakeEnv(nil), &bytes.Buffer{})
+
+	assert.Equal(t, err.Error(), "invalid config:\n  storage: unknown storage backend 'csv'\n  id-format: unknown ID format 'uuidv4'")
+}
+
+func TestPrintConfig(t *testing.T) {
+	config, printConfig, err := loadConfig([]string{"-print-config", "-admin-token", "secret", "-idle-timeout", "90s"}, fakeEnv(nil), &bytes.Buffer{})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, printConfig, true)
+
+	config.resolvePaths()
+
+	var output bytes.Buffer
+
+	assert.Equal(t, config.print(&output), nil)
+	assert.Equal(t, strings.Contains(output.String(), "admin-token: REDACTED\n"), true)
+	assert.Equal(t, strings.Contains(output.String(), "secret"), false)
+	assert.Equal(t, strings.Contains(output.String(), "idle-timeout: 1m30s\n"), true)
+
+	// The printed config can be loaded back in, apart from the hidden token
+	config.AdminToken = "REDACTED"
+
+	loaded, _, err := loadConfig([]string{"-config", writeConfigFile(t, output.String())}, fakeEnv(nil), &bytes.Buffer{})
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loaded, config)
+}
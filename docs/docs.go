@@ -30,139 +30,226 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/orderapi.IndexResponse"
+                            "$ref": "#/definitions/main.IndexResponse"
                         }
                     }
                 }
             }
         },
-        "/add-order": {
-            "post": {
-                "consumes": [
-                    "application/json"
-                ],
+        "/healthz": {
+            "get": {
+                "description": "Liveness check that succeeds as long as the server can handle requests at all",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Adds an order to the system",
-                "parameters": [
-                    {
-                        "description": "Order",
-                        "name": "order",
-                        "in": "body",
-                        "required": true,
+                "summary": "Reports that the server is running",
+                "responses": {
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/orderapi.Order"
+                            "$ref": "#/definitions/main.HealthResponse"
                         }
                     }
+                }
+            }
+        },
+        "/readyz": {
+            "get": {
+                "description": "Readiness check that fails while the order or archive store can't be read or written, e.g. because the\ndisk is full or the database was made read only",
+                "produces": [
+                    "application/json"
                 ],
+                "summary": "Reports whether the server can handle order requests",
                 "responses": {
-                    "201": {
-                        "description": "Created",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/orderapi.Order"
+                            "$ref": "#/definitions/main.HealthResponse"
                         }
                     },
-                    "500": {
-                        "description": "Failed to parse JSON",
+                    "503": {
+                        "description": "Result of each check",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/main.HealthResponse"
                         }
                     }
                 }
             }
         },
-        "/complete-order": {
-            "patch": {
+        "/status": {
+            "get": {
+                "description": "Uptime, how many orders there are and where they are stored along with the readiness checks",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Deactivates an order and archives it",
-                "parameters": [
-                    {
-                        "type": "integer",
-                        "description": "Order ID",
-                        "name": "id",
-                        "in": "query",
-                        "required": true
-                    }
-                ],
+                "summary": "Reports the state of the server",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/orderapi.Order"
+                            "$ref": "#/definitions/main.StatusResponse"
                         }
                     },
-                    "404": {
-                        "description": "Order with ID 'X' not found",
+                    "500": {
+                        "description": "Failed to access the order database",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Report with the checks that failed",
+                        "schema": {
+                            "$ref": "#/definitions/main.StatusResponse"
                         }
                     }
                 }
             }
         },
-        "/edit-order": {
-            "patch": {
-                "consumes": [
-                    "application/x-www-form-urlencoded"
+        "/v1/archive/orders": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
                 ],
+                "description": "Completed orders are moved out of the active set into the archive. This takes the same filters, sorting\nand paging as listing active orders",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Removes an order from the system",
+                "summary": "Lists archived orders",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "Order ID",
-                        "name": "id",
-                        "in": "query",
-                        "required": true
+                        "type": "array",
+                        "items": {
+                            "enum": [
+                                "OrderRecieved",
+                                "OrderProcessing",
+                                "OrderOutForDelivery",
+                                "OrderShipped",
+                                "OrderCancelled",
+                                "OrderReturned"
+                            ],
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "Only orders in these statuses",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Only active or inactive orders",
+                        "name": "active",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only orders for this recipient",
+                        "name": "recipient",
+                        "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Address",
+                        "description": "Only orders whose address contains this text",
                         "name": "address",
-                        "in": "formData",
-                        "required": true
+                        "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Recipient",
-                        "name": "recipient",
-                        "in": "formData",
-                        "required": true
+                        "description": "Only orders created at or after this RFC 3339 time",
+                        "name": "createdAfter",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only orders created before this RFC 3339 time",
+                        "name": "createdBefore",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "id",
+                            "createdAt",
+                            "orderStatus",
+                            "active",
+                            "recipient",
+                            "address",
+                            "-id",
+                            "-createdAt",
+                            "-orderStatus",
+                            "-active",
+                            "-recipient",
+                            "-address"
+                        ],
+                        "type": "string",
+                        "description": "Field to sort by, prefixed with - for descending order",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum number of orders to return (1-200, default 50)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/orderapi.Order"
+                            "$ref": "#/definitions/main.OrderPage"
                         }
                     },
-                    "404": {
-                        "description": "Order with ID 'X' not found",
+                    "400": {
+                        "description": "Description of the invalid parameter",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:read scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
             }
         },
-        "/get-order": {
+        "/v1/archive/orders/{id}": {
             "get": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Adds an order to the system",
+                "summary": "Gets an archived order",
                 "parameters": [
                     {
-                        "type": "integer",
+                        "type": "string",
                         "description": "Order ID",
                         "name": "id",
-                        "in": "query",
+                        "in": "path",
                         "required": true
                     }
                 ],
@@ -170,163 +257,1427 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/orderapi.Order"
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the order"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:read scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     },
                     "404": {
                         "description": "Order with ID 'X' not found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
             }
         },
-        "/remove-order": {
-            "delete": {
+        "/v1/archive/orders/{id}/restore": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "The order is reactivated so it can be changed again, e.g. to mark it as returned",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Removes an order from the system",
+                "summary": "Moves an archived order back into the active orders",
                 "parameters": [
                     {
-                        "type": "integer",
+                        "type": "string",
                         "description": "Order ID",
                         "name": "id",
-                        "in": "query",
+                        "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the archived order must still have",
+                        "name": "If-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/orderapi.Order"
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the order after the change"
+                            },
+                            "Location": {
+                                "type": "string",
+                                "description": "URL of the restored order"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:write scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     },
                     "404": {
                         "description": "Order with ID 'X' not found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "An active order with the same ID already exists",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Order has changed since the ETag in If-Match was read",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match header is required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
             }
         },
-        "/update-order-status": {
-            "patch": {
+        "/v1/orders": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "Results are paged. Pass the nextCursor from a response as the cursor parameter to get the next page,\nkeeping the same filters and sort order",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Updates an order's status",
+                "summary": "Lists orders",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "Order ID",
-                        "name": "id",
-                        "in": "query",
-                        "required": true
+                        "type": "array",
+                        "items": {
+                            "enum": [
+                                "OrderRecieved",
+                                "OrderProcessing",
+                                "OrderOutForDelivery",
+                                "OrderShipped",
+                                "OrderCancelled",
+                                "OrderReturned"
+                            ],
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "Only orders in these statuses",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Only active or inactive orders",
+                        "name": "active",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only orders for this recipient",
+                        "name": "recipient",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only orders whose address contains this text",
+                        "name": "address",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only orders created at or after this RFC 3339 time",
+                        "name": "createdAfter",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only orders created before this RFC 3339 time",
+                        "name": "createdBefore",
+                        "in": "query"
                     },
                     {
                         "enum": [
-                            "OrderRecieved",
-                            "OrderProcessing",
-                            "OrderOutForDelivery",
-                            "OrderShipped"
+                            "id",
+                            "createdAt",
+                            "orderStatus",
+                            "active",
+                            "recipient",
+                            "address",
+                            "-id",
+                            "-createdAt",
+                            "-orderStatus",
+                            "-active",
+                            "-recipient",
+                            "-address"
                         ],
                         "type": "string",
-                        "description": "Order Status",
-                        "name": "status",
-                        "in": "query",
-                        "required": true
+                        "description": "Field to sort by, prefixed with - for descending order",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum number of orders to return (1-200, default 50)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
                     }
                 ],
                 "responses": {
-                    "202": {
-                        "description": "Accepted",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/orderapi.Order"
+                            "$ref": "#/definitions/main.OrderPage"
                         }
                     },
-                    "404": {
-                        "description": "Order with id 'X' not found",
+                    "400": {
+                        "description": "Description of the invalid parameter",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/main.Problem"
                         }
                     },
-                    "423": {
-                        "description": "Order is no longer active",
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:read scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
-            }
-        }
-    },
-    "definitions": {
-        "orderapi.IndexResponse": {
-            "type": "object",
-            "properties": {
-                "documentationUrl": {
-                    "type": "string"
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "The order is given a generated ID unless the body already has one. New orders always start as\nOrderRecieved and active, whatever orderStatus and active the body has.\nRetrying with the same Idempotency-Key and body returns the original response instead of creating another order",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Adds an order to the system",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Unique key that makes the request safe to retry",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Order",
+                        "name": "order",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "Location": {
+                                "type": "string",
+                                "description": "URL of the new order"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Failed to parse JSON",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:write scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "An active or archived order with id 'X' already exists, or a request with the same Idempotency-Key is still being handled",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "422": {
+                        "description": "Fields that failed validation, or an Idempotency-Key reused with a different body",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
                 }
             }
         },
-        "orderapi.Item": {
-            "type": "object",
-            "properties": {
-                "name": {
-                    "type": "string"
+        "/v1/orders/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "Responses carry the order's ETag. Sending it back in If-None-Match gets a 304 while the order is unchanged",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Gets an order",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag from an earlier response",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the order"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "The order hasn't changed"
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:read scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Order with ID 'X' not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "The ID, status, history and timestamps of the order are managed by the server and can't be replaced",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Replaces an order's items, address, recipient and currency",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the order must still have for the change to be made",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Order",
+                        "name": "order",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the order after the change"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Failed to parse JSON",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:write scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Order with ID 'X' not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Order has changed since the ETag in If-Match was read",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "422": {
+                        "description": "Fields that failed validation",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "423": {
+                        "description": "Order is no longer active",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match header is required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "Only for admins cleaning up orders that should never have existed. Use the cancel route to stop an order\nwhile keeping its record",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Permanently deletes an order",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the order must still have for the change to be made",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:admin scope, or purging is disabled because no admin token or API keys are configured",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Order with ID 'X' not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Order has changed since the ETag in If-Match was read",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match header is required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "consumes": [
+                    "application/json",
+                    "application/x-www-form-urlencoded"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Changes an order's address or recipient",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the order must still have for the change to be made",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Fields to change, empty fields are left alone",
+                        "name": "edit",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.OrderEdit"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the order after the change"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Failed to parse request body",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:write scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Order with ID 'X' not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Order has changed since the ETag in If-Match was read",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "422": {
+                        "description": "Fields that failed validation",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "423": {
+                        "description": "Order is no longer active",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match header is required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/orders/{id}/cancel": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "Orders can only be cancelled before they go out for delivery. Cancelled orders are deactivated\nbut kept, so they still show up when getting and listing orders",
+                "consumes": [
+                    "application/json",
+                    "application/x-www-form-urlencoded"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Cancels an order",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the order must still have for the change to be made",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Why the order is being cancelled",
+                        "name": "cancel",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Cancellation"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the order after the change"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Failed to parse request body",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:write scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Order with ID 'X' not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Order has already gone out for delivery",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Order has changed since the ETag in If-Match was read",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "422": {
+                        "description": "Missing or unknown reason",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "423": {
+                        "description": "Order is no longer active",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match header is required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/orders/{id}/complete": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "Marks the order as shipped, which is only allowed once it is out for delivery, and moves it into the archive",
+                "consumes": [
+                    "application/json",
+                    "application/x-www-form-urlencoded"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Deactivates an order and archives it",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the order must still have for the change to be made",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Who completed the order and why",
+                        "name": "note",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/main.ChangeNote"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the order after the change"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Failed to parse request body",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:write scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Order with ID 'X' not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Order can't move to the requested status",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Order has changed since the ETag in If-Match was read",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match header is required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/orders/{id}/status": {
+            "put": {
+                "security": [
+                    {
+                        "ApiKey": []
+                    }
+                ],
+                "description": "Orders move through OrderRecieved, OrderProcessing, OrderOutForDelivery and OrderShipped in that order.\nThey can be cancelled before they go out for delivery and returned after.",
+                "consumes": [
+                    "application/json",
+                    "application/x-www-form-urlencoded"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Updates an order's status",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag the order must still have for the change to be made",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "New status",
+                        "name": "status",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.StatusUpdate"
+                        }
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/main.Order"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the order after the change"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Unknown status 'X' or an unreadable body",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or revoked API key",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "API key without the orders:write scope",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Order with id 'X' not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Order can't move to the requested status",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "412": {
+                        "description": "Order has changed since the ETag in If-Match was read",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "422": {
+                        "description": "Cancelling without a valid reason",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "423": {
+                        "description": "Order is no longer active",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match header is required",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to access the order database",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "main.CancelReason": {
+            "type": "string",
+            "enum": [
+                "customer_request",
+                "out_of_stock",
+                "payment_failed",
+                "fraud_suspected",
+                "duplicate_order",
+                "other"
+            ],
+            "x-enum-varnames": [
+                "CancelCustomerRequest",
+                "CancelOutOfStock",
+                "CancelPaymentFailed",
+                "CancelFraudSuspected",
+                "CancelDuplicateOrder",
+                "CancelOther"
+            ]
+        },
+        "main.Cancellation": {
+            "type": "object",
+            "required": [
+                "reason"
+            ],
+            "properties": {
+                "actor": {
+                    "type": "string"
+                },
+                "note": {
+                    "type": "string"
+                },
+                "reason": {
+                    "$ref": "#/definitions/main.CancelReason"
+                }
+            }
+        },
+        "main.ChangeNote": {
+            "type": "object",
+            "properties": {
+                "actor": {
+                    "type": "string"
+                },
+                "note": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.FieldError": {
+            "type": "object",
+            "properties": {
+                "field": {
+                    "description": "Path of the field, e.g. items[0].quantity",
+                    "type": "string"
+                },
+                "message": {
+                    "type": "string"
+                },
+                "rule": {
+                    "description": "Name of the rule that failed, e.g. required or max",
+                    "type": "string"
+                }
+            }
+        },
+        "main.HealthResponse": {
+            "type": "object",
+            "properties": {
+                "checks": {
+                    "description": "Result of each check, \"ok\" or why it failed",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
                 },
-                "price": {
-                    "type": "number"
+                "status": {
+                    "description": "\"ok\" or \"unavailable\"",
+                    "type": "string"
+                }
+            }
+        },
+        "main.IndexResponse": {
+            "type": "object",
+            "properties": {
+                "documentationUrl": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.Item": {
+            "type": "object",
+            "required": [
+                "name"
+            ],
+            "properties": {
+                "name": {
+                    "type": "string",
+                    "maxLength": 200
                 },
                 "quantity": {
+                    "type": "integer",
+                    "maximum": 10000
+                },
+                "subtotal": {
+                    "description": "UnitPrice times Quantity, calculated by the server",
                     "type": "integer"
+                },
+                "unitPrice": {
+                    "description": "Price of a single unit in minor units of the order's currency, e.g. cents",
+                    "type": "integer",
+                    "maximum": 1000000000000,
+                    "minimum": 0
                 }
             }
         },
-        "orderapi.Order": {
+        "main.Order": {
             "type": "object",
+            "required": [
+                "address",
+                "items",
+                "recipient"
+            ],
             "properties": {
                 "active": {
                     "type": "boolean"
                 },
                 "address": {
+                    "type": "string",
+                    "maxLength": 500
+                },
+                "createdAt": {
                     "type": "string"
                 },
-                "id": {
+                "currency": {
+                    "description": "ISO 4217 code of the currency every price on the order is in, USD if left out",
                     "type": "string"
                 },
+                "id": {
+                    "type": "string",
+                    "maxLength": 128
+                },
                 "items": {
                     "type": "array",
+                    "maxItems": 100,
+                    "minItems": 1,
                     "items": {
-                        "$ref": "#/definitions/orderapi.Item"
+                        "$ref": "#/definitions/main.Item"
                     }
                 },
                 "orderStatus": {
-                    "$ref": "#/definitions/orderapi.Status"
+                    "$ref": "#/definitions/main.Status"
+                },
+                "recipient": {
+                    "type": "string",
+                    "maxLength": 200
+                },
+                "statusHistory": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.StatusChange"
+                    }
+                },
+                "total": {
+                    "description": "Sum of the item subtotals, calculated by the server",
+                    "type": "integer"
+                },
+                "updatedAt": {
+                    "type": "string"
+                },
+                "version": {
+                    "description": "Starts at 1 and goes up every time the order changes. Sent as the ETag of the order",
+                    "type": "integer"
+                }
+            }
+        },
+        "main.OrderCounts": {
+            "type": "object",
+            "properties": {
+                "active": {
+                    "type": "integer"
+                },
+                "byStatus": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                },
+                "inactive": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.OrderEdit": {
+            "type": "object",
+            "properties": {
+                "address": {
+                    "type": "string",
+                    "maxLength": 500
                 },
                 "recipient": {
+                    "type": "string",
+                    "maxLength": 200
+                }
+            }
+        },
+        "main.OrderPage": {
+            "type": "object",
+            "properties": {
+                "nextCursor": {
+                    "description": "Pass as the cursor parameter to get the next page. Left out on the last page",
+                    "type": "string"
+                },
+                "orders": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Order"
+                    }
+                }
+            }
+        },
+        "main.Problem": {
+            "type": "object",
+            "properties": {
+                "allowedStatuses": {
+                    "description": "Statuses the order can move to, for invalid-transition problems",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Status"
+                    }
+                },
+                "code": {
+                    "description": "Machine readable error code",
+                    "type": "string"
+                },
+                "currentStatus": {
+                    "description": "Status the order is in, for invalid-transition problems",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.Status"
+                        }
+                    ]
+                },
+                "detail": {
+                    "description": "Explanation specific to this occurrence",
+                    "type": "string"
+                },
+                "errors": {
+                    "description": "Every field that broke a rule, for validation-failed problems",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.FieldError"
+                    }
+                },
+                "instance": {
+                    "description": "Path of the request that caused the problem",
+                    "type": "string"
+                },
+                "status": {
+                    "description": "HTTP status code",
+                    "type": "integer"
+                },
+                "title": {
+                    "description": "Short summary of the kind of problem, the same for every occurrence",
+                    "type": "string"
+                },
+                "type": {
+                    "description": "URI of the page describing this kind of problem",
                     "type": "string"
                 }
             }
         },
-        "orderapi.Status": {
+        "main.Status": {
             "type": "string",
             "enum": [
                 "OrderRecieved",
                 "OrderProcessing",
                 "OrderOutForDelivery",
-                "OrderShipped"
+                "OrderShipped",
+                "OrderCancelled",
+                "OrderReturned"
             ],
             "x-enum-varnames": [
                 "OrderRecieved",
                 "OrderProcessing",
                 "OrderOutForDelivery",
-                "OrderShipped"
+                "OrderShipped",
+                "OrderCancelled",
+                "OrderReturned"
             ]
+        },
+        "main.StatusChange": {
+            "type": "object",
+            "properties": {
+                "actor": {
+                    "type": "string"
+                },
+                "note": {
+                    "type": "string"
+                },
+                "reason": {
+                    "description": "Why the order was cancelled, only set on the change to OrderCancelled",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.CancelReason"
+                        }
+                    ]
+                },
+                "status": {
+                    "$ref": "#/definitions/main.Status"
+                },
+                "timestamp": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.StatusResponse": {
+            "type": "object",
+            "properties": {
+                "archived": {
+                    "$ref": "#/definitions/main.OrderCounts"
+                },
+                "checks": {
+                    "description": "Result of each check, \"ok\" or why it failed",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "orders": {
+                    "$ref": "#/definitions/main.OrderCounts"
+                },
+                "startedAt": {
+                    "type": "string"
+                },
+                "status": {
+                    "description": "\"ok\" or \"unavailable\"",
+                    "type": "string"
+                },
+                "storage": {
+                    "type": "object",
+                    "properties": {
+                        "archive": {
+                            "$ref": "#/definitions/main.StoreInfo"
+                        },
+                        "orders": {
+                            "$ref": "#/definitions/main.StoreInfo"
+                        }
+                    }
+                },
+                "uptimeSeconds": {
+                    "description": "Seconds since the server started",
+                    "type": "integer"
+                }
+            }
+        },
+        "main.StatusUpdate": {
+            "type": "object",
+            "properties": {
+                "actor": {
+                    "type": "string"
+                },
+                "note": {
+                    "type": "string"
+                },
+                "reason": {
+                    "description": "Why the order is being cancelled, required when the status is OrderCancelled",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.CancelReason"
+                        }
+                    ]
+                },
+                "status": {
+                    "$ref": "#/definitions/main.Status"
+                }
+            }
+        },
+        "main.StoreInfo": {
+            "type": "object",
+            "properties": {
+                "backend": {
+                    "type": "string"
+                },
+                "journalBytes": {
+                    "description": "Size of the JSON journal waiting to be folded into the database file",
+                    "type": "integer"
+                },
+                "path": {
+                    "type": "string"
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "ApiKey": {
+            "description": "API key or the admin token as \"Bearer \u003ckey\u003e\". Keys can also be sent in the X-API-Key header",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Returned from an update function when the order no longer matches the request's If-Match header
+var errPreconditionFailed = errors.New("order has changed")
+
+// Returned when a change is made without an If-Match header while they are required
+var errPreconditionRequired = errors.New("If-Match header required")
+
+// Returns the entity tag of an order, which changes every time the order does
+func orderETag(order Order) string {
+	return `"` + strconv.FormatInt(order.Version, 10) + `"`
+}
+
+// Reports whether an If-Match or If-None-Match header lists etag. With a weak comparison
+// W/ tags match their strong equivalents, with a strong one they never match
+func etagListed(header string, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+
+		if tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a check that fails with errPreconditionFailed unless the order matches the
+// request's If-Match header. Requests without the header pass the check unless the API
+// requires it, in which case errPreconditionRequired is returned straight away
+func (api *API) ifMatch(c *gin.Context) (func(order Order) error, error) {
+	header := c.GetHeader("If-Match")
+
+	if header == "" {
+		if api.requireIfMatch {
+			return nil, errPreconditionRequired
+		}
+
+		return func(order Order) error { return nil }, nil
+	}
+
+	return func(order Order) error {
+		if !etagListed(header, orderETag(order), false) {
+			return errPreconditionFailed
+		}
+
+		return nil
+	}, nil
+}
+
+// Writes an order along with its ETag
+func writeOrder(c *gin.Context, status int, order Order) {
+	c.Header("ETag", orderETag(order))
+	c.JSON(status, order)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How many orders a store holds
+type OrderCounts struct {
+	Total    int            `json:"total"`
+	Active   int            `json:"active"`
+	Inactive int            `json:"inactive"`
+	ByStatus map[Status]int `json:"byStatus"`
+}
+
+// Counts the orders in a store, using the store's own counts when it has them
+func countOrders(store OrderStore) (OrderCounts, error) {
+	if counter, ok := store.(OrderCounter); ok {
+		return counter.Count()
+	}
+
+	orders, err := store.List()
+
+	if err != nil {
+		return OrderCounts{}, err
+	}
+
+	counts := OrderCounts{Total: len(orders), ByStatus: map[Status]int{}}
+
+	for _, order := range orders {
+		counts.ByStatus[order.OrderStatus]++
+
+		if order.Active {
+			counts.Active++
+		} else {
+			counts.Inactive++
+		}
+	}
+
+	return counts, nil
+}
+
+// Result of checking whether a store can be used, "ok" or why it can't
+func checkStore(store OrderStore) string {
+	if checker, ok := store.(StoreChecker); ok {
+		if err := checker.Check(); err != nil {
+			return err.Error()
+		}
+	}
+
+	return "ok"
+}
+
+// Returns where a store keeps its orders
+func describeStore(store OrderStore) StoreInfo {
+	if describer, ok := store.(StoreDescriber); ok {
+		return describer.Describe()
+	}
+
+	return StoreInfo{Backend: "unknown"}
+}
+
+// swagger:model
+type HealthResponse struct {
+	// "ok" or "unavailable"
+	Status string `json:"status"`
+	// Result of each check, "ok" or why it failed
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Runs the readiness checks and reports whether all of them passed
+func (api *API) readiness() (map[string]string, bool) {
+	checks := map[string]string{
+		"orders":  checkStore(api.store),
+		"archive": checkStore(api.archive),
+	}
+
+	for _, result := range checks {
+		if result != "ok" {
+			return checks, false
+		}
+	}
+
+	return checks, true
+}
+
+// Healthz godoc
+//
+// @Summary Reports that the server is running
+// @Description Liveness check that succeeds as long as the server can handle requests at all
+// @Schemes http https
+// @Produce json
+// @Success 200 {object} HealthResponse
+// @Router /healthz [get]
+func (api *API) healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// Readyz godoc
+//
+// @Summary Reports whether the server can handle order requests
+// @Description Readiness check that fails while the order or archive store can't be read or written, e.g. because the
+// @Description disk is full or the database was made read only
+// @Schemes http https
+// @Produce json
+// @Success 200 {object} HealthResponse
+// @Failure 503 {object} HealthResponse "Result of each check"
+// @Router /readyz [get]
+func (api *API) readyz(c *gin.Context) {
+	checks, ready := api.readiness()
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, HealthResponse{Status: "unavailable", Checks: checks})
+		return
+	}
+
+	c.JSON(http.StatusOK, HealthResponse{Status: "ok", Checks: checks})
+}
+
+// swagger:model
+type StatusResponse struct {
+	HealthResponse
+	StartedAt time.Time `json:"startedAt"`
+	// Seconds since the server started
+	UptimeSeconds int64       `json:"uptimeSeconds"`
+	Orders        OrderCounts `json:"orders"`
+	Archived      OrderCounts `json:"archived"`
+	Storage       struct {
+		Orders  StoreInfo `json:"orders"`
+		Archive StoreInfo `json:"archive"`
+	} `json:"storage"`
+}
+
+// Status godoc
+//
+// @Summary Reports the state of the server
+// @Description Uptime, how many orders there are and where they are stored along with the readiness checks
+// @Schemes http https
+// @Produce json
+// @Success 200 {object} StatusResponse
+// @Failure 503 {object} StatusResponse "Report with the checks that failed"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /status [get]
+func (api *API) status(c *gin.Context) {
+	var response StatusResponse
+	var err error
+
+	response.Orders, err = countOrders(api.store)
+
+	if err != nil {
+		writeError(c, "", err)
+		return
+	}
+
+	response.Archived, err = countOrders(api.archive)
+
+	if err != nil {
+		writeError(c, "", err)
+		return
+	}
+
+	response.StartedAt = api.startedAt.UTC()
+	response.UptimeSeconds = int64(api.now().Sub(api.startedAt) / time.Second)
+	response.Storage.Orders = describeStore(api.store)
+	response.Storage.Archive = describeStore(api.archive)
+
+	checks, ready := api.readiness()
+	response.Checks = checks
+
+	if !ready {
+		response.Status = "unavailable"
+		c.JSON(http.StatusServiceUnavailable, response)
+		return
+	}
+
+	response.Status = "ok"
+	c.JSON(http.StatusOK, response)
+}
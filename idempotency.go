@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header clients set to make retrying a request safe
+const idempotencyHeader = "Idempotency-Key"
+
+// Set on responses that were replayed from an earlier request with the same key
+const idempotencyReplayedHeader = "Idempotent-Replayed"
+
+// The response to the first request made with an idempotency key
+type idempotencyRecord struct {
+	// Hash of the request the key was first used with
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	CreatedAt   time.Time   `json:"createdAt"`
+}
+
+// A record as it is appended to the journal
+type idempotencyEntry struct {
+	Key string `json:"key"`
+	idempotencyRecord
+}
+
+// IdempotencyStore remembers the responses to requests made with an idempotency key so
+// retries get the same response instead of repeating the request. Each new record is
+// appended to a journal, which is folded into a JSON snapshot once it grows past a size
+// limit, dropping records that are older than the TTL. Records survive a restart
+type IdempotencyStore struct {
+	path string
+	ttl  time.Duration
+	now  func() time.Time
+
+	// Guards the records in memory. Never held while writing to disk
+	mu      sync.Mutex
+	records map[string]idempotencyRecord
+	// Keys of requests that haven't finished yet
+	pending map[string]bool
+
+	// Guards the journal and the snapshot so a compaction can't lose an entry appended
+	// while it runs
+	writeMu sync.Mutex
+	journal *journal
+}
+
+// Opens the idempotency records saved at path, replaying the journal next to it, and starts
+// compacting the journal in the background whenever it grows past maxJournalSize bytes.
+// A maxJournalSize of zero or less disables automatic compaction
+func NewIdempotencyStore(path string, ttl time.Duration, maxJournalSize int64) (*IdempotencyStore, error) {
+	s := &IdempotencyStore{
+		path:    path,
+		ttl:     ttl,
+		now:     time.Now,
+		records: map[string]idempotencyRecord{},
+		pending: map[string]bool{},
+	}
+
+	if err := recoverDatabase(path); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &s.records); err != nil {
+			return nil, err
+		}
+	}
+
+	// The store isn't shared yet so records can be added without holding mu
+	s.journal, err = openJournal(path, maxJournalSize, func(data []byte) error {
+		var entry idempotencyEntry
+
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+
+		s.records[entry.Key] = entry.idempotencyRecord
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.prune()
+
+	go s.journal.compactor(s.compact)
+
+	return s, nil
+}
+
+// Drops records older than the TTL. The caller must hold mu
+func (s *IdempotencyStore) prune() {
+	cutoff := s.now().Add(-s.ttl)
+
+	for key, record := range s.records {
+		if record.CreatedAt.Before(cutoff) {
+			delete(s.records, key)
+		}
+	}
+}
+
+// Returned by begin when another request with the same key is still being handled
+var errIdempotencyKeyInUse = errors.New("idempotency key in use")
+
+// Returned by begin when the key was first used with a different request
+var errIdempotencyKeyReused = errors.New("idempotency key reused")
+
+// Starts a request made with key. Returns the saved response if the request has been made
+// before, or nil if the caller should handle it and then call finish
+func (s *IdempotencyStore) begin(key string, fingerprint string) (*idempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending[key] {
+		return nil, errIdempotencyKeyInUse
+	}
+
+	if record, ok := s.records[key]; ok && s.now().Sub(record.CreatedAt) < s.ttl {
+		if record.Fingerprint != fingerprint {
+			return nil, errIdempotencyKeyReused
+		}
+
+		return &record, nil
+	}
+
+	s.pending[key] = true
+
+	return nil, nil
+}
+
+// Finishes a request started with begin. The response is saved unless record is nil,
+// which lets the request be tried again with the same key
+func (s *IdempotencyStore) finish(key string, record *idempotencyRecord) error {
+	if record == nil {
+		s.mu.Lock()
+		delete(s.pending, key)
+		s.mu.Unlock()
+
+		return nil
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	err := s.journal.append(idempotencyEntry{Key: key, idempotencyRecord: *record})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, key)
+
+	if err != nil {
+		return err
+	}
+
+	s.records[key] = *record
+
+	return nil
+}
+
+// Writes a snapshot of the records that haven't expired and empties the journal
+func (s *IdempotencyStore) compact() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.journal.compact(func() error {
+		s.mu.Lock()
+		s.prune()
+		data, err := json.Marshal(s.records)
+		s.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		return writeFileAtomic(s.path, data)
+	})
+}
+
+// Stops background compaction, folds the journal into the snapshot and closes the journal
+func (s *IdempotencyStore) Close() error {
+	return s.journal.close(s.compact)
+}
+
+// Buffers a copy of the response so it can be saved once the handler is done
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Middleware that makes a route safe to retry. The first response to a request with an
+// Idempotency-Key header is saved and replayed for any retry with the same key and body.
+// Reusing a key with a different body is rejected, as is a retry that arrives while the
+// first request is still being handled
+func (api *API) idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyHeader)
+
+		if api.idempotency == nil || key == "" {
+			c.Next()
+			return
+		}
+
+		// Keys are only unique to the client that picked them, so one client can't be handed
+		// another's response by guessing its key
+		recordKey := client(c) + " " + key
+
+		body, err := io.ReadAll(c.Request.Body)
+
+		if err != nil {
+			writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidBody, "Failed to read request body"))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(hash[:])
+
+		record, err := api.idempotency.begin(recordKey, fingerprint)
+
+		switch {
+		case errors.Is(err, errIdempotencyKeyInUse):
+			writeProblem(c, newProblem(http.StatusConflict, codeIdempotencyKeyInUse, "A request with this Idempotency-Key is still being handled"))
+			return
+		case errors.Is(err, errIdempotencyKeyReused):
+			writeProblem(c, newProblem(http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was already used with a different request body"))
+			return
+		case record != nil:
+			for name, values := range record.Header {
+				for _, value := range values {
+					c.Writer.Header().Add(name, value)
+				}
+			}
+
+			c.Header(idempotencyReplayedHeader, "true")
+			c.Data(record.Status, record.Header.Get("Content-Type"), record.Body)
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		saved := false
+
+		// Release the key if the handler panics so the client can try again
+		defer func() {
+			if !saved {
+				api.idempotency.finish(recordKey, nil)
+			}
+		}()
+
+		c.Next()
+
+		// Server errors mean nothing was done so the client should be able to try again
+		if writer.Status() >= http.StatusInternalServerError {
+			return
+		}
+
+		header := http.Header{}
+
+		for _, name := range []string{"Content-Type", "Location", "ETag"} {
+			if value := writer.Header().Get(name); value != "" {
+				header.Set(name, value)
+			}
+		}
+
+		saved = true
+
+		err = api.idempotency.finish(recordKey, &idempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      writer.Status(),
+			Header:      header,
+			Body:        writer.body.Bytes(),
+			CreatedAt:   api.idempotency.now(),
+		})
+
+		if err != nil {
+			// The request itself succeeded so all that is lost is the ability to replay it
+			api.log(c).Error("Failed to save idempotency key", "key", key, "error", err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+)
+
+// IDGenerator hands out IDs for orders created without one
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// Generates time ordered UUIDs (RFC 9562 version 7)
+type uuidV7Generator struct{}
+
+func (uuidV7Generator) NewID() (string, error) {
+	id, err := uuid.NewV7()
+
+	if err != nil {
+		return "", err
+	}
+
+	return id.String(), nil
+}
+
+// Generates ULIDs, which sort by creation time like UUIDv7 but are shorter
+type ulidGenerator struct{}
+
+func (ulidGenerator) NewID() (string, error) {
+	return ulid.Make().String(), nil
+}
+
+// Generates increasing integers. The last number handed out is saved in a file so a number
+// is never handed out twice, even after the order that had it is purged
+type sequenceGenerator struct {
+	mu   sync.Mutex
+	last uint64
+	// File the last number is saved in, or empty to keep it in memory only
+	path string
+}
+
+func (g *sequenceGenerator) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	next := strconv.FormatUint(g.last+1, 10)
+
+	// Save the number before handing it out so a crash can't lead to it being reused
+	if g.path != "" {
+		if err := writeFileAtomic(g.path, []byte(next+"\n")); err != nil {
+			return "", err
+		}
+	}
+
+	g.last++
+
+	return next, nil
+}
+
+// Returns the path of the file a sequence for the orders in the database at db is saved in
+func sequencePath(db string) string {
+	return db + ".sequence"
+}
+
+// Creates the ID generator for the given format. A sequence carries on from the number
+// saved at sequenceFile, or from the largest numeric ID in the stores if that is higher,
+// which is the case when a sequence was used before the file existed
+func newIDGenerator(format string, sequenceFile string, stores ...OrderStore) (IDGenerator, error) {
+	switch format {
+	case "uuidv7":
+		return uuidV7Generator{}, nil
+	case "ulid":
+		return ulidGenerator{}, nil
+	case "sequence":
+		g := &sequenceGenerator{path: sequenceFile}
+
+		if sequenceFile != "" {
+			if err := recoverDatabase(sequenceFile); err != nil {
+				return nil, err
+			}
+
+			data, err := os.ReadFile(sequenceFile)
+
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+
+			if err == nil {
+				g.last, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", sequenceFile, err)
+				}
+			}
+		}
+
+		for _, store := range stores {
+			orders, err := store.List()
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, order := range orders {
+				if n, err := strconv.ParseUint(order.ID, 10, 64); err == nil && n > g.last {
+					g.last = n
+				}
+			}
+		}
+
+		return g, nil
+	}
+
+	return nil, fmt.Errorf("unknown ID format '%s'", format)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Returns the name of the journal kept next to the database at path
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// An append-only file of JSON entries kept next to a snapshot. Each entry is flushed to disk
+// as it is appended and the entries are folded into a fresh snapshot once the journal grows
+// past a size limit. A journal has no lock of its own, its owner must hold the lock that
+// guards its snapshot while appending to or compacting it
+type journal struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+
+	compactions chan struct{}
+	done        chan struct{}
+}
+
+// Opens the journal kept next to the database at path, passing every entry in it to apply.
+// A partially written final line left by a crash is cut off, anything else unreadable is an
+// error. A maxSize of zero or less disables automatic compaction
+func openJournal(path string, maxSize int64, apply func(entry []byte) error) (*journal, error) {
+	j := &journal{
+		path:        journalPath(path),
+		maxSize:     maxSize,
+		compactions: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	file, err := os.OpenFile(j.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	var replayed int
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				slog.Warn("Discarding incomplete journal entry", "path", j.path, "offset", offset)
+
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return nil, err
+				}
+			}
+
+			break
+		}
+
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		if err := apply(bytes.TrimSpace(line)); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt journal entry at offset %d: %w", offset, err)
+		}
+
+		offset += int64(len(line))
+		replayed++
+	}
+
+	if replayed > 0 {
+		slog.Info("Replayed journal", "path", j.path, "entries", replayed)
+	}
+
+	j.file = file
+	j.size = offset
+
+	return j, nil
+}
+
+// Appends an entry to the journal and flushes it to disk, asking for a compaction once the
+// journal is too big
+func (j *journal) append(entry any) error {
+	data, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	n, err := j.file.Write(data)
+
+	if err == nil {
+		err = j.file.Sync()
+	}
+
+	if err != nil {
+		// Don't leave a partial line behind for the next append to run into
+		j.file.Truncate(j.size)
+		return err
+	}
+
+	j.size += int64(n)
+
+	if j.maxSize > 0 && j.size > j.maxSize {
+		select {
+		case j.compactions <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Checks the journal can still be written to by appending a byte, flushing it to disk and
+// cutting it off again. A crash part way leaves an incomplete line, which replay discards
+func (j *journal) probe() error {
+	_, err := j.file.Write([]byte{' '})
+
+	if err == nil {
+		err = j.file.Sync()
+	}
+
+	if truncateErr := j.file.Truncate(j.size); err == nil {
+		err = truncateErr
+	}
+
+	return err
+}
+
+// Runs compact whenever append asks for a compaction, until the journal is closed
+func (j *journal) compactor(compact func() error) {
+	for {
+		select {
+		case <-j.compactions:
+			if err := compact(); err != nil {
+				slog.Error("Failed to compact journal", "path", j.path, "error", err)
+			}
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// Calls snapshot to write everything in the journal to the snapshot and then empties the
+// journal. Does nothing if the journal is already empty
+func (j *journal) compact(snapshot func() error) error {
+	if j.size == 0 {
+		return nil
+	}
+
+	if err := snapshot(); err != nil {
+		return err
+	}
+
+	// A crash here leaves entries that are already in the snapshot,
+	// replaying them again on startup is harmless
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.size = 0
+
+	return nil
+}
+
+// Stops background compaction, runs compact one last time to fold whatever is left into
+// the snapshot and closes the journal
+func (j *journal) close(compact func() error) error {
+	close(j.done)
+
+	err := compact()
+
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
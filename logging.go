@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header carrying the ID that ties a request to its log lines
+const requestIDHeader = "X-Request-ID"
+
+// Key the request's logger is kept under in the gin context
+const loggerKey = "logger"
+
+// Longest request ID accepted from a client, longer ones are replaced
+const maxRequestIDLength = 128
+
+// Creates a logger writing to w at the given level (debug, info, warn or error) as either
+// human readable text or one JSON object per line
+func newLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+
+	options := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+
+	return nil, fmt.Errorf("unknown log format '%s'", format)
+}
+
+// Reports whether a client supplied request ID is safe to log and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Gives every request an ID, keeping the one the client sent in X-Request-ID if there is one,
+// and a logger that includes it. The ID is sent back in the response's X-Request-ID header
+func (api *API) requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+
+		logger := api.logger.With("requestId", id)
+
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+			logger = logger.With("traceId", span.TraceID().String())
+		}
+
+		c.Header(requestIDHeader, id)
+		c.Set(loggerKey, logger)
+		c.Next()
+	}
+}
+
+// Returns the logger of the request, or the API's logger outside of a request
+func (api *API) log(c *gin.Context) *slog.Logger {
+	if c != nil {
+		if logger, ok := c.Value(loggerKey).(*slog.Logger); ok {
+			return logger
+		}
+	}
+
+	return api.logger
+}
+
+// Logs every request once it has been handled. Server errors are logged as errors
+func (api *API) accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+
+		c.Next()
+
+		level := slog.LevelInfo
+
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+
+		api.log(c).Log(c.Request.Context(), level, "Request handled",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", c.Writer.Status(),
+			"durationMs", float64(time.Since(started).Microseconds())/1000,
+			"clientIp", c.ClientIP(),
+			"bytes", c.Writer.Size(),
+		)
+	}
+}
+
+// Turns a panic in a handler into a 500 problem and logs it with the request's ID
+func (api *API) recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		api.log(c).Error("Request panicked", "error", err, "stack", string(debug.Stack()))
+
+		// Too late to send a problem if the handler had started its response
+		if c.Writer.Written() {
+			c.Abort()
+			return
+		}
+
+		writeProblem(c, newProblem(http.StatusInternalServerError, codeInternal, "The server hit an unexpected error"))
+	})
+}
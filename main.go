@@ -1,26 +1,134 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 
 	"fmt"
+	// docs "example/order-api/docs"
+)
 
-	"os"
+// API holds the handlers for the order routes and the store they operate on
+type API struct {
+	store OrderStore
+	// Completed orders are moved here to keep the active store small
+	archive OrderStore
+	ids     IDGenerator
+	now     func() time.Time
+	// When the API was created, reported by the status route
+	startedAt time.Time
+	logger    *slog.Logger
 
-    swaggerFiles "github.com/swaggo/files"
-    ginSwagger "github.com/swaggo/gin-swagger"
+	// Provides the tracer for request and storage spans
+	tracerProvider trace.TracerProvider
 
-    // docs "example/order-api/docs"
-)
+	// Served on /metrics unless nil
+	metrics *Metrics
+
+	// Whether changes to an order must send an If-Match header
+	requireIfMatch bool
+
+	// Bearer token that has every scope. It is ignored when empty
+	adminToken string
+
+	// API keys clients authenticate with. Only the admin token is accepted when nil
+	keys *KeyStore
+
+	// Whether read and write routes need a credential even before any API key has been
+	// created. Once there are keys they always do
+	requireAPIKey bool
+
+	// Responses to requests made with an Idempotency-Key. Keys are ignored when nil
+	idempotency *IdempotencyStore
+}
 
-var orders []Order
+// Creates an API backed by the given store that gives new orders UUIDv7 IDs and archives
+// completed orders in memory
+func NewAPI(store OrderStore) *API {
+	api := &API{store: store, archive: NewMemoryStore(), ids: uuidV7Generator{}, now: time.Now, startedAt: time.Now(), logger: slog.Default(),
+		tracerProvider: noop.NewTracerProvider()}
+	api.metrics = newMetrics(api)
+
+	return api
+}
+
+// Describes a status change made now
+func (api *API) statusChange(status Status, note ChangeNote) StatusChange {
+	return StatusChange{
+		Status:    status,
+		Timestamp: api.now().UTC(),
+		Actor:     note.Actor,
+		Note:      note.Note,
+	}
+}
+
+// Returns the ID of the order a request is for. The /v1 routes have it in the path
+// and the legacy routes in the query string
+func orderID(c *gin.Context) string {
+	if id := c.Param("id"); id != "" {
+		return id
+	}
+
+	return c.Query("id")
+}
+
+// Returns the URL of an order
+func orderLocation(id string) string {
+	return "/v1/orders/" + url.PathEscape(id)
+}
+
+// Binds an optional request body. A request without one leaves obj as it is
+func bindOptional(c *gin.Context, obj any) error {
+	if c.Request.ContentLength == 0 {
+		return nil
+	}
+
+	return traceBind(c, func() error { return c.ShouldBind(obj) })
+}
+
+// Who made a change and why. Sent as JSON or form fields
+type ChangeNote struct {
+	Actor string `json:"actor" form:"actor"`
+	Note  string `json:"note" form:"note"`
+}
+
+// Body for changing an order's status
+type StatusUpdate struct {
+	Status Status `json:"status" form:"status"`
+	// Why the order is being cancelled, required when the status is OrderCancelled
+	Reason CancelReason `json:"reason" form:"reason" validate:"required_if=Status OrderCancelled,omitempty,cancelreason"`
+	ChangeNote
+}
+
+// Body for cancelling an order
+type Cancellation struct {
+	Reason CancelReason `json:"reason" form:"reason" validate:"required,cancelreason"`
+	ChangeNote
+}
+
+// Fields of an order that can be edited. Fields left empty aren't changed
+type OrderEdit struct {
+	Address   string `json:"address" form:"address" validate:"max=500"`
+	Recipient string `json:"recipient" form:"recipient" validate:"max=200"`
+}
 
 // swagger:model
 type IndexResponse struct {
-    DocsUrl string `json:"documentationUrl"`
+	DocsUrl string `json:"documentationUrl"`
 }
 
 // Index godoc
@@ -30,227 +138,853 @@ type IndexResponse struct {
 // @Produce plain
 // @Success 200 {object} IndexResponse
 // @Router / [get]
-func index(c *gin.Context) {
-	c.JSON(http.StatusOK, IndexResponse { DocsUrl: "/swagger/index.html"})
+func (api *API) index(c *gin.Context) {
+	c.JSON(http.StatusOK, IndexResponse{DocsUrl: "/swagger/index.html"})
 }
 
 // AddOrder godoc
 //
 // @Summary Adds an order to the system
+// @Security ApiKey
 // @Schemes http https
 // @Accept json
 // @Produce json
+// @Description The order is given a generated ID unless the body already has one. New orders always start as
+// @Description OrderRecieved and active, whatever orderStatus and active the body has.
+// @Description Retrying with the same Idempotency-Key and body returns the original response instead of creating another order
+// @Param Idempotency-Key header string false "Unique key that makes the request safe to retry"
 // @Param order body Order true "Order"
 // @Success 201 {object} Order
-// @Failure 500 {string} string "Failed to parse JSON"
-// @Router /add-order [post]
-func addOrder(c *gin.Context) {
+// @Header 201 {string} Location "URL of the new order"
+// @Failure 400 {object} Problem "Failed to parse JSON"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:write scope"
+// @Failure 409 {object} Problem "An active or archived order with id 'X' already exists, or a request with the same Idempotency-Key is still being handled"
+// @Failure 422 {object} Problem "Fields that failed validation, or an Idempotency-Key reused with a different body"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/orders [post]
+func (api *API) addOrder(c *gin.Context) {
 	var newOrder Order
 
-	if err := c.BindJSON(&newOrder); err != nil {
-		c.String(500, "Failed to parse JSON")
+	if err := traceBind(c, func() error { return c.ShouldBindJSON(&newOrder) }); err != nil {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidJSON, "Failed to parse JSON"))
 		return
 	}
 
-	orders = append(orders, newOrder)
+	if err := ValidateStruct(newOrder); err != nil {
+		writeError(c, newOrder.ID, err)
+		return
+	}
 
-	saveDatabase(orders)
+	// Status, timestamps and history belong to the server, whatever the client sent. Every
+	// order starts out received and active so its history begins at the first status
+	newOrder.OrderStatus = OrderRecieved
+	newOrder.Active = true
 
-	c.JSON(http.StatusCreated, newOrder)
+	created := api.statusChange(newOrder.OrderStatus, ChangeNote{})
+
+	newOrder.CreatedAt = created.Timestamp
+	newOrder.UpdatedAt = created.Timestamp
+	newOrder.StatusHistory = []StatusChange{created}
+	newOrder.Version = 1
+
+	if err := newOrder.computeTotals(); err != nil {
+		writeError(c, newOrder.ID, err)
+		return
+	}
+
+	if err := api.createOrder(c.Request.Context(), &newOrder); err != nil {
+		writeError(c, newOrder.ID, err)
+		return
+	}
+
+	api.log(c).Info("Order created", "orderId", newOrder.ID, "status", newOrder.OrderStatus, "items", len(newOrder.Items))
+
+	c.Header("Location", orderLocation(newOrder.ID))
+	writeOrder(c, http.StatusCreated, newOrder)
+}
+
+// Saves a new order, giving it a generated ID if the client didn't supply one. IDs of
+// archived orders are taken too, so an order can always be restored
+func (api *API) createOrder(ctx context.Context, order *Order) error {
+	if order.ID != "" {
+		return api.createIfIDFree(ctx, *order)
+	}
+
+	// A generated ID can still clash with one a client picked themselves so try a few
+	for attempt := 0; attempt < 5; attempt++ {
+		id, err := api.ids.NewID()
+
+		if err != nil {
+			return err
+		}
+
+		order.ID = id
+
+		if err := api.createIfIDFree(ctx, *order); !errors.Is(err, ErrOrderExists) {
+			return err
+		}
+	}
+
+	return ErrOrderExists
+}
+
+// Saves a new order unless an active or archived order already has its ID
+func (api *API) createIfIDFree(ctx context.Context, order Order) error {
+	_, err := api.archived(ctx).Get(order.ID)
+
+	if err == nil {
+		return ErrOrderExists
+	}
+
+	if !errors.Is(err, ErrOrderNotFound) {
+		return err
+	}
+
+	return api.orders(ctx).Create(order)
 }
 
 // GetOrder godoc
 //
-// @Summary Adds an order to the system
-// @Param   id  query    int true "Order ID"
+// @Summary Gets an order
+// @Security ApiKey
+// @Description Responses carry the order's ETag. Sending it back in If-None-Match gets a 304 while the order is unchanged
+// @Param   id              path    string true     "Order ID"
+// @Param   If-None-Match   header  string false    "ETag from an earlier response"
 // @Schemes http https
 // @Produce json
 // @Success 200 {object} Order
-// @Failure 404 {string} string "Order with ID 'X' not found"
-// @Router /get-order [get]
-func getOrder(c *gin.Context) {
-	id := c.Query("id")
-
-	for i := range orders {
-		if orders[i].ID == id {
-			c.JSON(http.StatusOK, orders[i])
-			return
-		}
+// @Header  200 {string} ETag "Version of the order"
+// @Success 304 "The order hasn't changed"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:read scope"
+// @Failure 404 {object} Problem "Order with ID 'X' not found"
+// @Router /v1/orders/{id} [get]
+func (api *API) getOrder(c *gin.Context) {
+	id := orderID(c)
+
+	order, err := api.orders(c.Request.Context()).Get(id)
+
+	if err != nil {
+		writeError(c, id, err)
+		return
 	}
 
-	errMsg := fmt.Sprintf("Order with id '%s' not found", id)
+	if etagListed(c.GetHeader("If-None-Match"), orderETag(order), true) {
+		c.Header("ETag", orderETag(order))
+		c.Status(http.StatusNotModified)
+		return
+	}
 
-	c.String(http.StatusNotFound, errMsg)
+	writeOrder(c, http.StatusOK, order)
+}
+
+// ListOrders godoc
+//
+// @Summary Lists orders
+// @Security ApiKey
+// @Description Results are paged. Pass the nextCursor from a response as the cursor parameter to get the next page,
+// @Description keeping the same filters and sort order
+// @Param   status          query   []Status    false   "Only orders in these statuses"    collectionFormat(csv)
+// @Param   active          query   bool        false   "Only active or inactive orders"
+// @Param   recipient       query   string      false   "Only orders for this recipient"
+// @Param   address         query   string      false   "Only orders whose address contains this text"
+// @Param   createdAfter    query   string      false   "Only orders created at or after this RFC 3339 time"
+// @Param   createdBefore   query   string      false   "Only orders created before this RFC 3339 time"
+// @Param   sort            query   string      false   "Field to sort by, prefixed with - for descending order" Enums(id, createdAt, orderStatus, active, recipient, address, -id, -createdAt, -orderStatus, -active, -recipient, -address)
+// @Param   limit           query   int         false   "Maximum number of orders to return (1-200, default 50)"
+// @Param   cursor          query   string      false   "Cursor from the previous page"
+// @Schemes http https
+// @Produce json
+// @Success 200 {object} OrderPage
+// @Failure 400 {object} Problem "Description of the invalid parameter"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:read scope"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/orders [get]
+func (api *API) listOrders(c *gin.Context) {
+	query, err := parseOrderQuery(c.Request.URL.Query())
+
+	if err != nil {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidQuery, err.Error()))
+		return
+	}
+
+	orders, err := findOrders(api.orders(c.Request.Context()), query)
+
+	if err != nil {
+		writeError(c, "", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, query.apply(orders))
+}
+
+// Returned from an update function when the order can no longer be changed
+var errOrderInactive = errors.New("order is no longer active")
+
+// Returned from an update function when asked to move to a status that doesn't exist
+type unknownStatusError struct {
+	status Status
+}
+
+func (e *unknownStatusError) Error() string {
+	return fmt.Sprintf("Unknown status '%s'", e.status)
 }
 
 // UpdateOrderStatus godoc
 //
 // @Summary Updates an order's status
-// @Param   id      query    int    true    "Order ID"
-// @Param   status  query    Status true    "Order Status"
+// @Security ApiKey
+// @Description Orders move through OrderRecieved, OrderProcessing, OrderOutForDelivery and OrderShipped in that order.
+// @Description They can be cancelled before they go out for delivery and returned after.
+// @Param   id      path     string         true    "Order ID"
+// @Param   If-Match    header  string  false   "ETag the order must still have for the change to be made"
+// @Param   status  body     StatusUpdate   true    "New status"
 // @Schemes http https
+// @Accept json,x-www-form-urlencoded
 // @Produce json
 // @Success 202 {object} Order
-// @Failure 423 {string} string "Order is no longer active"
-// @Failure 404 {string} string "Order with id 'X' not found"
-// @Router /update-order-status [patch]
-func updateOrderStatus(c *gin.Context) {
-	id := c.Query("id")
-	status := c.PostForm("status")
-
-	for i := range orders {
-		if orders[i].ID == id {
-			if !orders[i].Active {
-				c.String(http.StatusLocked, "Order is no longer active")
-				return
-			}
+// @Header  202 {string} ETag "Version of the order after the change"
+// @Failure 400 {object} Problem "Unknown status 'X' or an unreadable body"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:write scope"
+// @Failure 422 {object} Problem "Cancelling without a valid reason"
+// @Failure 409 {object} Problem "Order can't move to the requested status"
+// @Failure 423 {object} Problem "Order is no longer active"
+// @Failure 404 {object} Problem "Order with id 'X' not found"
+// @Failure 412 {object} Problem "Order has changed since the ETag in If-Match was read"
+// @Failure 428 {object} Problem "If-Match header is required"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/orders/{id}/status [put]
+func (api *API) updateOrderStatus(c *gin.Context) {
+	id := orderID(c)
+
+	var update StatusUpdate
+
+	if err := bindOptional(c, &update); err != nil {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidBody, "Failed to parse request body"))
+		return
+	}
+
+	if err := ValidateStruct(update); err != nil {
+		writeError(c, id, err)
+		return
+	}
 
-			orders[i].OrderStatus = Status(status)
+	check, err := api.ifMatch(c)
 
-			saveDatabase(orders)
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
 
-			c.JSON(http.StatusAccepted, orders[i])
-			return
+	status := update.Status
+	change := api.statusChange(status, update.ChangeNote)
+
+	if status == OrderCancelled {
+		change.Reason = update.Reason
+	}
+
+	var from Status
+
+	order, err := api.orders(c.Request.Context()).Update(id, func(order *Order) error {
+		if err := check(*order); err != nil {
+			return err
 		}
+
+		if !order.Active {
+			return errOrderInactive
+		}
+
+		if !status.Valid() {
+			return &unknownStatusError{status: status}
+		}
+
+		from = order.OrderStatus
+
+		return order.transition(change)
+	})
+
+	if err != nil {
+		writeError(c, id, err)
+		return
 	}
 
-	errMsg := fmt.Sprintf("Order with id '%s' not found", id)
+	api.log(c).Info("Order status changed", "orderId", id, "from", from, "to", status, "version", order.Version)
 
-	c.String(http.StatusNotFound, errMsg)
+	writeOrder(c, http.StatusAccepted, order)
 }
 
-// RemoveOrder godoc
+// CancelOrder godoc
 //
-// @Summary Removes an order from the system
-// @Param   id  query    int true "Order ID"
+// @Summary Cancels an order
+// @Security ApiKey
+// @Description Orders can only be cancelled before they go out for delivery. Cancelled orders are deactivated
+// @Description but kept, so they still show up when getting and listing orders
+// @Param   id          path    string          true    "Order ID"
+// @Param   If-Match    header  string          false   "ETag the order must still have for the change to be made"
+// @Param   cancel      body    Cancellation    true    "Why the order is being cancelled"
 // @Schemes http https
+// @Accept json,x-www-form-urlencoded
 // @Produce json
 // @Success 200 {object} Order
-// @Failure 404 {string} string "Order with ID 'X' not found"
-// @Router /remove-order [delete]
-func removeOrder(c *gin.Context) {
-	id := c.Query("id")
+// @Header  200 {string} ETag "Version of the order after the change"
+// @Failure 400 {object} Problem "Failed to parse request body"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:write scope"
+// @Failure 404 {object} Problem "Order with ID 'X' not found"
+// @Failure 409 {object} Problem "Order has already gone out for delivery"
+// @Failure 412 {object} Problem "Order has changed since the ETag in If-Match was read"
+// @Failure 422 {object} Problem "Missing or unknown reason"
+// @Failure 423 {object} Problem "Order is no longer active"
+// @Failure 428 {object} Problem "If-Match header is required"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/orders/{id}/cancel [post]
+func (api *API) cancelOrder(c *gin.Context) {
+	id := orderID(c)
+
+	var cancel Cancellation
+
+	if err := traceBind(c, func() error { return c.ShouldBind(&cancel) }); err != nil {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidBody, "Failed to parse request body"))
+		return
+	}
 
-	for i := range orders {
-		if orders[i].ID == id {
-			orders = remove(orders, i)
+	if err := ValidateStruct(cancel); err != nil {
+		writeError(c, id, err)
+		return
+	}
 
-			saveDatabase(orders)
+	check, err := api.ifMatch(c)
 
-			c.JSON(http.StatusOK, orders[i])
-			return
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	change := api.statusChange(OrderCancelled, cancel.ChangeNote)
+	change.Reason = cancel.Reason
+
+	var from Status
+
+	order, err := api.orders(c.Request.Context()).Update(id, func(order *Order) error {
+		if err := check(*order); err != nil {
+			return err
 		}
+
+		if !order.Active {
+			return errOrderInactive
+		}
+
+		from = order.OrderStatus
+
+		return order.transition(change)
+	})
+
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	api.log(c).Info("Order cancelled", "orderId", id, "from", from, "reason", cancel.Reason, "version", order.Version)
+
+	writeOrder(c, http.StatusOK, order)
+}
+
+// PurgeOrder godoc
+//
+// @Summary Permanently deletes an order
+// @Security ApiKey
+// @Description Only for admins cleaning up orders that should never have existed. Use the cancel route to stop an order
+// @Description while keeping its record
+// @Param   id  path    string true "Order ID"
+// @Param   If-Match    header  string  false   "ETag the order must still have for the change to be made"
+// @Schemes http https
+// @Produce json
+// @Success 200 {object} Order
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:admin scope, or purging is disabled because no admin token or API keys are configured"
+// @Failure 404 {object} Problem "Order with ID 'X' not found"
+// @Failure 412 {object} Problem "Order has changed since the ETag in If-Match was read"
+// @Failure 428 {object} Problem "If-Match header is required"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/orders/{id} [delete]
+func (api *API) purgeOrder(c *gin.Context) {
+	id := orderID(c)
+
+	check, err := api.ifMatch(c)
+
+	if err != nil {
+		writeError(c, id, err)
+		return
 	}
 
-	errMsg := fmt.Sprintf("Order with id '%s' not found", id)
+	order, err := api.orders(c.Request.Context()).Delete(id, check)
 
-	c.String(http.StatusNotFound, errMsg)
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	api.log(c).Info("Order removed", "orderId", id, "status", order.OrderStatus)
+
+	c.JSON(http.StatusOK, order)
 }
 
 // CompleteOrder godoc
 //
-// @Summary Deactivates an order and archives it 
-// @Param   id  query    int true "Order ID"
+// @Summary Deactivates an order and archives it
+// @Security ApiKey
+// @Description Marks the order as shipped, which is only allowed once it is out for delivery, and moves it into the archive
+// @Param   id      path     string     true    "Order ID"
+// @Param   If-Match    header  string  false   "ETag the order must still have for the change to be made"
+// @Param   note    body     ChangeNote false   "Who completed the order and why"
 // @Schemes http https
+// @Accept json,x-www-form-urlencoded
 // @Produce json
 // @Success 200 {object} Order
-// @Failure 404 {string} string "Order with ID 'X' not found"
-// @Router /complete-order [patch]
-func completeOrder(c *gin.Context) {
-	id := c.Query("id")
+// @Header  200 {string} ETag "Version of the order after the change"
+// @Failure 400 {object} Problem "Failed to parse request body"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:write scope"
+// @Failure 404 {object} Problem "Order with ID 'X' not found"
+// @Failure 409 {object} Problem "Order can't move to the requested status"
+// @Failure 412 {object} Problem "Order has changed since the ETag in If-Match was read"
+// @Failure 428 {object} Problem "If-Match header is required"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/orders/{id}/complete [post]
+func (api *API) completeOrder(c *gin.Context) {
+	id := orderID(c)
+
+	var note ChangeNote
+
+	if err := bindOptional(c, &note); err != nil {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidBody, "Failed to parse request body"))
+		return
+	}
 
-	for i := range orders {
-		if orders[i].ID == id {
-			orders[i].Active = false
-			orders[i].OrderStatus = OrderShipped
+	check, err := api.ifMatch(c)
 
-			saveDatabase(orders)
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
 
-			c.JSON(http.StatusOK, orders[i])
-			return
+	order, err := api.orders(c.Request.Context()).Update(id, func(order *Order) error {
+		if err := check(*order); err != nil {
+			return err
+		}
+
+		if order.OrderStatus != OrderShipped {
+			if err := order.transition(api.statusChange(OrderShipped, note)); err != nil {
+				return err
+			}
 		}
+
+		order.Active = false
+		order.UpdatedAt = api.now().UTC()
+
+		return nil
+	})
+
+	if err != nil {
+		writeError(c, id, err)
+		return
 	}
 
-	errMsg := fmt.Sprintf("Order with id '%s' not found", id)
+	api.log(c).Info("Order completed", "orderId", id, "version", order.Version)
 
-	c.String(http.StatusNotFound, errMsg)
+	// The order is complete either way. If the move fails it is archived on the next start
+	if err := api.archiveOrder(c.Request.Context(), order); err != nil {
+		api.log(c).Error("Failed to archive order", "orderId", id, "error", err)
+	} else {
+		c.Header("Content-Location", archivedOrderLocation(id))
+	}
+
+	writeOrder(c, http.StatusOK, order)
 }
 
 // EditOrder godoc
 //
-// @Summary Removes an order from the system
-// @Param   id          query       int     true    "Order ID"
-// @Param   address     formData    string  true    "Address"
-// @Param   recipient   formData    string  true    "Recipient"
+// @Summary Changes an order's address or recipient
+// @Security ApiKey
+// @Param   id      path    string      true    "Order ID"
+// @Param   If-Match    header  string  false   "ETag the order must still have for the change to be made"
+// @Param   edit    body    OrderEdit   true    "Fields to change, empty fields are left alone"
 // @Schemes http https
-// @Accept x-www-form-urlencoded
+// @Accept json,x-www-form-urlencoded
 // @Produce json
 // @Success 200 {object} Order
-// @Failure 404 {string} string "Order with ID 'X' not found"
-// @Router /edit-order [patch]
-func editOrder(c *gin.Context) {
-	id := c.Query("id")
-	address := c.PostForm("address")
-	recipient := c.PostForm("recipient")
-
-	for i := range orders {
-		if orders[i].ID == id {
-			if address != "" {
-				orders[i].Address = address
-			}
+// @Header  200 {string} ETag "Version of the order after the change"
+// @Failure 400 {object} Problem "Failed to parse request body"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:write scope"
+// @Failure 422 {object} Problem "Fields that failed validation"
+// @Failure 404 {object} Problem "Order with ID 'X' not found"
+// @Failure 412 {object} Problem "Order has changed since the ETag in If-Match was read"
+// @Failure 423 {object} Problem "Order is no longer active"
+// @Failure 428 {object} Problem "If-Match header is required"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/orders/{id} [patch]
+func (api *API) editOrder(c *gin.Context) {
+	id := orderID(c)
+
+	var edit OrderEdit
+
+	if err := bindOptional(c, &edit); err != nil {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidBody, "Failed to parse request body"))
+		return
+	}
 
-			if recipient != "" {
-				orders[i].Recipient = recipient
-			}
+	if err := ValidateStruct(edit); err != nil {
+		writeError(c, id, err)
+		return
+	}
 
-			saveDatabase(orders)
+	check, err := api.ifMatch(c)
 
-			c.JSON(http.StatusOK, orders[i])
-			return
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	order, err := api.orders(c.Request.Context()).Update(id, func(order *Order) error {
+		if err := check(*order); err != nil {
+			return err
+		}
+
+		if !order.Active {
+			return errOrderInactive
+		}
+
+		if edit.Address != "" {
+			order.Address = edit.Address
+		}
+
+		if edit.Recipient != "" {
+			order.Recipient = edit.Recipient
+		}
+
+		order.UpdatedAt = api.now().UTC()
+
+		return nil
+	})
+
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	api.log(c).Info("Order edited", "orderId", id, "address", edit.Address != "", "recipient", edit.Recipient != "", "version", order.Version)
+
+	writeOrder(c, http.StatusOK, order)
+}
+
+// ReplaceOrder godoc
+//
+// @Summary Replaces an order's items, address, recipient and currency
+// @Security ApiKey
+// @Description The ID, status, history and timestamps of the order are managed by the server and can't be replaced
+// @Param   id      path    string  true    "Order ID"
+// @Param   If-Match    header  string  false   "ETag the order must still have for the change to be made"
+// @Param   order   body    Order   true    "Order"
+// @Schemes http https
+// @Accept json
+// @Produce json
+// @Success 200 {object} Order
+// @Header  200 {string} ETag "Version of the order after the change"
+// @Failure 400 {object} Problem "Failed to parse JSON"
+// @Failure 401 {object} Problem "Missing, invalid or revoked API key"
+// @Failure 403 {object} Problem "API key without the orders:write scope"
+// @Failure 422 {object} Problem "Fields that failed validation"
+// @Failure 404 {object} Problem "Order with ID 'X' not found"
+// @Failure 412 {object} Problem "Order has changed since the ETag in If-Match was read"
+// @Failure 423 {object} Problem "Order is no longer active"
+// @Failure 428 {object} Problem "If-Match header is required"
+// @Failure 500 {object} Problem "Failed to access the order database"
+// @Router /v1/orders/{id} [put]
+func (api *API) replaceOrder(c *gin.Context) {
+	id := orderID(c)
+
+	var replacement Order
+
+	if err := traceBind(c, func() error { return c.ShouldBindJSON(&replacement) }); err != nil {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeInvalidJSON, "Failed to parse JSON"))
+		return
+	}
+
+	if replacement.ID != "" && replacement.ID != id {
+		writeProblem(c, newProblem(http.StatusBadRequest, codeIDMismatch, "Order ID in the body doesn't match the URL"))
+		return
+	}
+
+	if err := ValidateStruct(replacement); err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	check, err := api.ifMatch(c)
+
+	if err != nil {
+		writeError(c, id, err)
+		return
+	}
+
+	order, err := api.orders(c.Request.Context()).Update(id, func(order *Order) error {
+		if err := check(*order); err != nil {
+			return err
 		}
+
+		if !order.Active {
+			return errOrderInactive
+		}
+
+		order.Items = replacement.Items
+		order.Address = replacement.Address
+		order.Recipient = replacement.Recipient
+		order.Currency = replacement.Currency
+		order.UpdatedAt = api.now().UTC()
+
+		return nil
+	})
+
+	if err != nil {
+		writeError(c, id, err)
+		return
 	}
 
-	errMsg := fmt.Sprintf("Order with id '%s' not found", id)
+	api.log(c).Info("Order replaced", "orderId", id, "items", len(order.Items), "version", order.Version)
 
-	c.String(http.StatusNotFound, errMsg)
+	writeOrder(c, http.StatusOK, order)
+}
 
+// Database file each storage backend uses when no path is given
+var defaultDatabasePaths = map[string]string{
+	"json":   "orders.json",
+	"sqlite": "orders.db",
 }
 
-//  @title Order API
-//  @version 1.0
-//  @description A simple Order tracking API for an ecommerce site. View source code here: https://github.com/grqphical07/order-api
-//  @license.name MIT
-//  @license.url https://github.com/grqphical07/order-api/blob/main/LICENSE
-//  @BasePath /
+// Opens the storage backend with the given name
+func openStore(backend string, path string, maxJournalSize int64) (OrderStore, error) {
+	if path == "" {
+		path = defaultDatabasePaths[backend]
+	}
+
+	switch backend {
+	case "json":
+		return NewJSONFileStore(path, maxJournalSize)
+	case "sqlite":
+		return NewSQLiteStore(path)
+	}
+
+	return nil, fmt.Errorf("unknown storage backend '%s'", backend)
+}
+
+// @title Order API
+// @version 1.0
+// @description A simple Order tracking API for an ecommerce site. View source code here: https://github.com/grqphical07/order-api
+// @license.name MIT
+// @license.url https://github.com/grqphical07/order-api/blob/main/LICENSE
+// @BasePath /
 // @Schemes http https
+// @securityDefinitions.apikey ApiKey
+// @in header
+// @name Authorization
+// @description API key or the admin token as "Bearer <key>". Keys can also be sent in the X-API-Key header
 func main() {
-	// Read our database file
-	data, err := os.ReadFile("orders.json")
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		err := keysCommand(os.Args[2:], os.Getenv, os.Stdout, os.Stderr)
+
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	config, printConfig, err := loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	config.resolvePaths()
+
+	if printConfig {
+		if err := config.print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	logger, err := newLogger(os.Stderr, config.LogLevel, config.LogFormat)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Anything still logging through the log package ends up here too
+	slog.SetDefault(logger)
+
+	// Stop on the first SIGINT or SIGTERM. Once shutdown has started the signals are
+	// handled normally again so a second one kills the server straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := run(ctx, config, logger); err != nil {
+		logger.Error("Server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Runs the server with the given config until ctx is done. Every store is closed, which
+// writes out anything still pending, before returning
+func run(ctx context.Context, config Config, logger *slog.Logger) (err error) {
+	if config.LogLevel == "debug" {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	// Load our database file
+	store, err := openStore(config.Storage, config.DB, config.JournalMaxBytes)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeStore(logger, "orders", store, &err)
+
+	archive, err := openStore(config.Storage, config.ArchiveDB, config.JournalMaxBytes)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeStore(logger, "archive", archive, &err)
+
+	tracerProvider, shutdownTracing, err := newTracerProvider(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Send whatever spans are still waiting in the batch
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
+	api := NewAPI(store)
+	api.archive = archive
+	api.logger = logger
+	api.tracerProvider = tracerProvider
+	api.metrics.observeStore("orders", store)
+	api.metrics.observeStore("archive", archive)
+	api.requireIfMatch = config.RequireIfMatch
+	api.adminToken = config.AdminToken
+	api.requireAPIKey = config.RequireAPIKey
+
+	if config.APIKeys != "" {
+		api.keys, err = NewKeyStore(config.APIKeys)
+
+		if err != nil {
+			return err
+		}
+
+		if empty, _ := api.keys.Empty(); empty && api.requireAPIKey && api.adminToken == "" {
+			logger.Warn("No API keys have been created so every order route will refuse requests, create one with 'order-api keys create'", "path", config.APIKeys)
+		}
+	}
+
+	api.ids, err = newIDGenerator(config.IDFormat, sequencePath(config.DB), store, archive)
+
+	if err != nil {
+		return err
+	}
+
+	api.idempotency, err = NewIdempotencyStore(config.IdempotencyDB, time.Duration(config.IdempotencyTTL), config.JournalMaxBytes)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeStore(logger, "idempotency", api.idempotency, &err)
+
+	// Catch up on orders completed before archiving existed or whose move was interrupted
+	archived, err := api.archiveCompleted()
 
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if archived > 0 {
+		logger.Info("Archived completed orders", "count", archived)
+	}
+
+	if !config.Metrics {
+		api.metrics = nil
+	}
+
+	server := &http.Server{
+		Handler:      api.router(config),
+		ReadTimeout:  time.Duration(config.ReadTimeout),
+		WriteTimeout: time.Duration(config.WriteTimeout),
+		IdleTimeout:  time.Duration(config.IdleTimeout),
 	}
 
-	// Decode the JSON into a list of Order structs
-	err = json.Unmarshal(data, &orders)
+	listener, err := net.Listen("tcp", config.Listen)
 
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// Setup our API webserver
-	router := gin.Default()
+	logger.Info("Listening", "address", listener.Addr().String())
 
-    router.StaticFile("/docs/swagger.json", "docs/swagger.json")
+	if err := serve(ctx, server, listener, time.Duration(config.ShutdownTimeout)); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+
+	logger.Info("Stopped serving requests")
 
-    router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.URL("/docs/swagger.json")))
+	return nil
+}
 
-	router.GET("/", index)
-	router.POST("/add-order", addOrder)
-	router.GET("/get-order", getOrder)
-	router.PATCH("/update-order-status", updateOrderStatus)
-	router.DELETE("/remove-order", removeOrder)
-	router.PATCH("/complete-order", completeOrder)
-	router.PATCH("/edit-order", editOrder)
-	router.Run("localhost:6969")
+// Closes a store when run returns, reporting a failure through err unless run already failed
+func closeStore(logger *slog.Logger, name string, store io.Closer, err *error) {
+	closeErr := store.Close()
+
+	if closeErr == nil {
+		return
+	}
+
+	closeErr = fmt.Errorf("failed to close %s store: %w", name, closeErr)
+
+	if *err == nil {
+		*err = closeErr
+	} else {
+		logger.Error("Failed to close store", "store", name, "error", closeErr)
+	}
 }
@@ -2,42 +2,66 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/assert/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
-var router *gin.Engine = gin.Default()
+// Creates a router with every order route backed by the given store
+func newRouter(store OrderStore) *gin.Engine {
+	api := NewAPI(store)
+	api.adminToken = testAdminToken
 
-func setupSuite(tb testing.TB) func(tb testing.TB) {
+	router := gin.Default()
+	api.registerRoutes(router)
 
-	err := os.WriteFile("orders.json", []byte("[]"), 0644)
+	return router
+}
 
-	if err != nil {
-		panic(err)
-	}
+// Admin token the test routers accept
+const testAdminToken = "test-admin-token"
 
-	// Return a function to teardown the test
-	return func(tb testing.TB) {
-		e := os.Remove("orders.json")
-		if e != nil {
-			log.Fatal(e)
-		}
-	}
+// Headers that authenticate a request as an admin
+var adminHeader = http.Header{"Authorization": {"Bearer " + testAdminToken}}
+
+// Creates a router with every order route backed by an in-memory store holding the given orders
+func setupRouter(orders ...Order) (*gin.Engine, *MemoryStore) {
+	store := NewMemoryStore(orders...)
+
+	return newRouter(store), store
 }
 
-func TestIndex(t *testing.T) {
+func exampleOrder() Order {
+	return Order{ID: "1",
+		Active: true, Address: "123 Example Street",
+		Items:       []Item{{Name: "Laptop", Quantity: 1}},
+		Recipient:   "John Doe",
+		OrderStatus: OrderRecieved}
+}
 
-	router.GET("/", index)
+func TestIndex(t *testing.T) {
+	router, _ := setupRouter(exampleOrder())
 
 	req, err := http.NewRequest("GET", "/", nil)
 
@@ -47,18 +71,17 @@ func TestIndex(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+
+	var response IndexResponse
+
+	json.Unmarshal(w.Body.Bytes(), &response)
+
 	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, response.DocsUrl, "/swagger/index.html")
 }
 
 func TestGetOrder(t *testing.T) {
-	orders = append(orders,
-		Order{ID: "1",
-			Active: true, Address: "123 Example Street",
-			Items:       []Item{{Name: "Laptop", Quantity: 1}},
-			Recipient:   "John Doe",
-			OrderStatus: OrderRecieved})
-
-	router.GET("/get-order", getOrder)
+	router, store := setupRouter(exampleOrder())
 
 	req, err := http.NewRequest("GET", "/get-order?id=1", nil)
 
@@ -79,13 +102,14 @@ func TestGetOrder(t *testing.T) {
 
 	json.Unmarshal(responseData, &order)
 
+	expected, _ := store.Get("1")
+
 	assert.Equal(t, http.StatusOK, w.Code)
-	assert.Equal(t, order, orders[0])
+	assert.Equal(t, order, expected)
 }
 
 func TestAddOrder(t *testing.T) {
-	teardownSuite := setupSuite(t)
-	defer teardownSuite(t)
+	router, store := setupRouter(exampleOrder())
 
 	orderToAdd := Order{ID: "2",
 		Active: true, Address: "125 Example Street",
@@ -93,8 +117,6 @@ func TestAddOrder(t *testing.T) {
 		Recipient:   "Jean Doe",
 		OrderStatus: OrderProcessing}
 
-	router.POST("/add-order", addOrder)
-
 	data, err := json.Marshal(orderToAdd)
 
 	if err != nil {
@@ -120,25 +142,224 @@ func TestAddOrder(t *testing.T) {
 
 	json.Unmarshal(responseData, &order)
 
+	stored, err := store.Get("2")
+
 	assert.Equal(t, http.StatusCreated, w.Code)
-	assert.Equal(t, order, orders[1])
+	assert.Equal(t, err, nil)
+	assert.Equal(t, order, stored)
+}
+
+func TestNewOrdersStartReceived(t *testing.T) {
+	sqlite, err := NewSQLiteStore(filepath.Join(t.TempDir(), "orders.db"))
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer sqlite.Close()
+
+	stores := map[string]OrderStore{"memory": NewMemoryStore(), "sqlite": sqlite}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			router := newRouter(store)
+
+			// Whatever status and active flag the client sends is ignored
+			for _, status := range []Status{"", OrderCancelled, OrderShipped} {
+				order := exampleOrder()
+				order.ID = ""
+				order.Active = false
+				order.OrderStatus = status
+
+				var created Order
 
+				w := sendJSON(router, "POST", "/v1/orders", order, &created)
+
+				assert.Equal(t, w.Code, http.StatusCreated)
+				assert.Equal(t, created.OrderStatus, OrderRecieved)
+				assert.Equal(t, created.Active, true)
+				assert.Equal(t, len(created.StatusHistory), 1)
+				assert.Equal(t, created.StatusHistory[0].Status, OrderRecieved)
+
+				// The order can move through the usual transitions
+				w = sendJSON(router, "PUT", "/v1/orders/"+created.ID+"/status", StatusUpdate{Status: OrderProcessing}, nil)
+
+				assert.Equal(t, w.Code, http.StatusAccepted)
+			}
+		})
+	}
 }
 
-func TestUpdateOrder(t *testing.T) {
-	teardownSuite := setupSuite(t)
-	defer teardownSuite(t)
-	router.PATCH("/update-order-status", updateOrderStatus)
+func TestAddOrderGeneratesID(t *testing.T) {
+	router, store := setupRouter()
+
+	order := exampleOrder()
+	order.ID = ""
+
+	data, _ := json.Marshal(order)
+
+	req, err := http.NewRequest("POST", "/add-order", bytes.NewReader(data))
+
+	if err != nil {
+		panic(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var created Order
+
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	_, err = store.Get(created.ID)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NotEqual(t, created.ID, "")
+	assert.Equal(t, w.Header().Get("Location"), "/v1/orders/"+created.ID)
+	assert.Equal(t, err, nil)
+}
+
+func TestAddOrderConflict(t *testing.T) {
+	router, store := setupRouter(exampleOrder())
+
+	order := exampleOrder()
+	order.Address = "125 Example Street"
+
+	data, _ := json.Marshal(order)
+
+	req, err := http.NewRequest("POST", "/add-order", bytes.NewReader(data))
+
+	if err != nil {
+		panic(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	stored, _ := store.Get("1")
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, stored.Address, "123 Example Street")
+}
+
+func TestSequenceIDs(t *testing.T) {
+	order := exampleOrder()
+	order.ID = "41"
+
+	path := filepath.Join(t.TempDir(), "orders.json.sequence")
+	ids, err := newIDGenerator("sequence", path, NewMemoryStore(exampleOrder(), order))
+
+	assert.Equal(t, err, nil)
+
+	for _, want := range []string{"42", "43"} {
+		id, err := ids.NewID()
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, id, want)
+	}
+
+	// The sequence carries on after a restart even if the newest orders were purged
+	ids, err = newIDGenerator("sequence", path, NewMemoryStore(exampleOrder()))
+
+	assert.Equal(t, err, nil)
+
+	id, _ := ids.NewID()
+
+	assert.Equal(t, id, "44")
+
+	_, err = newIDGenerator("guid", "", NewMemoryStore())
+
+	assert.NotEqual(t, err, nil)
+}
+
+func TestOrderTotals(t *testing.T) {
+	// Orders saved before prices were integers have float prices and no currency
+	var legacy Order
+
+	json.Unmarshal([]byte(`{"id": "1", "items": [{"name": "Laptop", "price": 999.99, "quantity": 2}, {"name": "Mouse", "price": 0.1, "quantity": 3}]}`), &legacy)
+
+	assert.Equal(t, legacy.Currency, "USD")
+	assert.Equal(t, legacy.Items[0].UnitPrice, int64(99999))
+	assert.Equal(t, legacy.Items[0].Subtotal, int64(199998))
+	assert.Equal(t, legacy.Items[1].UnitPrice, int64(10))
+	assert.Equal(t, legacy.Total, int64(200028))
+
+	var yen Order
+
+	json.Unmarshal([]byte(`{"id": "2", "currency": "JPY", "items": [{"name": "Laptop", "price": 150000, "quantity": 1}]}`), &yen)
+
+	assert.Equal(t, yen.Items[0].UnitPrice, int64(150000))
+
+	data, _ := json.Marshal(legacy)
+
+	assert.Equal(t, strings.Contains(string(data), `"unitPrice":99999`), true)
+	assert.Equal(t, strings.Contains(string(data), `"price"`), false)
+
+	// Totals that don't fit in an int64 are rejected rather than wrapping around
+	huge := Order{Items: []Item{{Name: "Yacht", UnitPrice: math.MaxInt64 / 2, Quantity: 3}}}
+
+	assert.Equal(t, huge.computeTotals(), error(errTotalOverflow))
+	assert.Equal(t, NewMemoryStore().Create(huge), error(errTotalOverflow))
+
+	huge.Items = []Item{{Name: "Yacht", UnitPrice: math.MaxInt64 / 2, Quantity: 1}, {Name: "Yacht", UnitPrice: math.MaxInt64 / 2, Quantity: 1}, {Name: "Dinghy", UnitPrice: 2, Quantity: 1}}
+
+	assert.Equal(t, huge.computeTotals(), error(errTotalOverflow))
+
+	router, store := setupRouter()
+
+	var problem Problem
 
-	orders = append(orders,
-		Order{ID: "1",
-			Active: true, Address: "123 Example Street",
-			Items:       []Item{{Name: "Laptop", Quantity: 1}},
-			Recipient:   "John Doe",
-			OrderStatus: OrderRecieved})
+	w := sendJSON(router, "POST", "/v1/orders", map[string]any{
+		"address":   "123 Example Street",
+		"recipient": "John Doe",
+		"items":     []map[string]any{{"name": "Yacht", "unitPrice": 9000000000000000000, "quantity": 2}},
+	}, &problem)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, problem.Errors[0].Field, "items[0].unitPrice")
+	assert.Equal(t, problem.Errors[0].Rule, "max")
+
+	counts, _ := store.Count()
+
+	assert.Equal(t, counts.Total, 0)
+}
+
+func TestAddOrderStorageError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "orders.json")
+
+	os.WriteFile(path, []byte("[]"), 0644)
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	router := newRouter(store)
+
+	// Nothing can be written once the journal is closed
+	store.journal.file.Close()
+
+	data, _ := json.Marshal(exampleOrder())
+
+	req, err := http.NewRequest("POST", "/add-order", bytes.NewReader(data))
+
+	if err != nil {
+		panic(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestUpdateOrder(t *testing.T) {
+	router, store := setupRouter(exampleOrder())
 
 	form_data := url.Values{
-		"status": {"3"},
+		"status": {string(OrderProcessing)},
 	}
 
 	req, err := http.NewRequest("PATCH", "/update-order-status?id=1", strings.NewReader(form_data.Encode()))
@@ -162,14 +383,17 @@ func TestUpdateOrder(t *testing.T) {
 
 	json.Unmarshal(responseData, &order)
 
+	stored, _ := store.Get("1")
+
 	assert.Equal(t, http.StatusAccepted, w.Code)
-	assert.Equal(t, order.OrderStatus, orders[0].OrderStatus)
+	assert.Equal(t, order.OrderStatus, stored.OrderStatus)
 }
 
 func TestCompleteOrder(t *testing.T) {
-	teardownSuite := setupSuite(t)
-	defer teardownSuite(t)
-	router.PATCH("/complete-order", completeOrder)
+	outForDelivery := exampleOrder()
+	outForDelivery.OrderStatus = OrderOutForDelivery
+
+	router, _ := setupRouter(outForDelivery)
 
 	req, err := http.NewRequest("PATCH", "/complete-order?id=1", nil)
 
@@ -192,19 +416,16 @@ func TestCompleteOrder(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Equal(t, order.Active, false)
+	assert.Equal(t, order.OrderStatus, OrderShipped)
+
+	// An order that hasn't gone out yet can't be completed
+	router, _ = setupRouter(exampleOrder())
+
+	assert.Equal(t, send(router, "PATCH", "/complete-order?id=1", nil, ""), http.StatusConflict)
 }
 
 func TestEditOrder(t *testing.T) {
-	teardownSuite := setupSuite(t)
-	defer teardownSuite(t)
-	router.PATCH("/edit-order", editOrder)
-
-	// orders = append(orders,
-	// 	Order{ID: "1",
-	// 		Active: true, Address: "123 Example Street",
-	// 		Items:       []Item{{Name: "Laptop", Quantity: 1}},
-	// 		Recipient:   "John Doe",
-	// 		OrderStatus: OrderRecieved})
+	router, _ := setupRouter(exampleOrder())
 
 	form_data := url.Values{
 		"address":   {"240 Park Street"},
@@ -237,29 +458,56 @@ func TestEditOrder(t *testing.T) {
 	assert.Equal(t, order.Recipient, form_data["recipient"][0])
 }
 
-func TestGetOrderError(t *testing.T) {
-	teardownSuite := setupSuite(t)
-	defer teardownSuite(t)
+func TestUpdateOrderStatusTransitions(t *testing.T) {
+	router, store := setupRouter(exampleOrder())
 
-	req, err := http.NewRequest("GET", "/get-order?id=5", nil)
+	form_data := url.Values{
+		"status": {string(OrderShipped)},
+	}
+
+	req, err := http.NewRequest("PATCH", "/update-order-status?id=1", strings.NewReader(form_data.Encode()))
 
 	if err != nil {
 		panic(err)
 	}
 
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	assert.Equal(t, http.StatusNotFound, w.Code)
+	var response Problem
+
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	stored, _ := store.Get("1")
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, response.Code, codeInvalidTransition)
+	assert.Equal(t, response.CurrentStatus, OrderRecieved)
+	assert.Equal(t, response.AllowedStatuses, []Status{OrderProcessing, OrderCancelled})
+	assert.Equal(t, stored.OrderStatus, OrderRecieved)
+
+	// Statuses that don't exist are rejected outright
+	form := url.Values{"status": {"3"}}.Encode()
+
+	code := send(router, "PATCH", "/update-order-status?id=1", strings.NewReader(form), "application/x-www-form-urlencoded")
+
+	assert.Equal(t, http.StatusBadRequest, code)
 }
 
-func TestAddOrderErrors(t *testing.T) {
-	teardownSuite := setupSuite(t)
-	defer teardownSuite(t)
+func TestStatusHistory(t *testing.T) {
+	router, _ := setupRouter()
 
-	data := []byte("{870sasdfals: iudsaiofh} /")
+	data, _ := json.Marshal(exampleOrder())
 
-	req, err := http.NewRequest("POST", "/add-order", bytes.NewReader(data))
+	send(router, "POST", "/add-order", bytes.NewReader(data), "application/json")
+
+	form := url.Values{"status": {string(OrderProcessing)}, "actor": {"warehouse"}, "note": {"Picked"}}.Encode()
+
+	send(router, "PATCH", "/update-order-status?id=1", strings.NewReader(form), "application/x-www-form-urlencoded")
+
+	req, err := http.NewRequest("GET", "/get-order?id=1", nil)
 
 	if err != nil {
 		panic(err)
@@ -268,58 +516,1540 @@ func TestAddOrderErrors(t *testing.T) {
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	body, err := io.ReadAll(w.Body)
+	var order Order
+
+	json.Unmarshal(w.Body.Bytes(), &order)
+
+	assert.Equal(t, len(order.StatusHistory), 2)
+	assert.Equal(t, order.StatusHistory[0].Status, OrderRecieved)
+	assert.Equal(t, order.StatusHistory[0].Timestamp, order.CreatedAt)
+	assert.Equal(t, order.StatusHistory[1].Status, OrderProcessing)
+	assert.Equal(t, order.StatusHistory[1].Actor, "warehouse")
+	assert.Equal(t, order.StatusHistory[1].Note, "Picked")
+	assert.Equal(t, order.UpdatedAt, order.StatusHistory[1].Timestamp)
+	assert.Equal(t, order.CreatedAt.IsZero(), false)
+}
+
+// Fetches a page of orders from the list endpoint
+func listPage(router *gin.Engine, query string) (int, OrderPage) {
+	req, err := http.NewRequest("GET", "/list-orders?"+query, nil)
 
 	if err != nil {
 		panic(err)
 	}
 
-	assert.Equal(t, http.StatusBadRequest, w.Code)
-	assert.Equal(t, "Failed to parse JSON", string(body[:]))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var page OrderPage
+
+	json.Unmarshal(w.Body.Bytes(), &page)
+
+	return w.Code, page
 }
 
-func TestUpdateOrderStatusErrors(t *testing.T) {
-	teardownSuite := setupSuite(t)
-	defer teardownSuite(t)
+// Returns the IDs of the orders on a page
+func pageIDs(page OrderPage) []string {
+	ids := []string{}
 
-	orders = []Order{{ID: "1",
-		Active: false, Address: "123 Example Street",
-		Items:       []Item{{Name: "Laptop", Quantity: 1}},
-		Recipient:   "John Doe",
-		OrderStatus: OrderRecieved}}
+	for _, order := range page.Orders {
+		ids = append(ids, order.ID)
+	}
 
-	form_data := url.Values{
-		"status": {"3"},
+	return ids
+}
+
+func TestListOrders(t *testing.T) {
+	start := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	var orders []Order
+
+	for i, status := range []Status{OrderRecieved, OrderProcessing, OrderShipped, OrderProcessing, OrderRecieved} {
+		order := exampleOrder()
+		order.ID = strconv.Itoa(i + 1)
+		order.OrderStatus = status
+		order.Active = status != OrderShipped
+		order.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+		order.Address = fmt.Sprintf("%d Example Street", 100+i)
+
+		orders = append(orders, order)
 	}
 
-	req, err := http.NewRequest("PATCH", "/update-order-status?id=1", strings.NewReader(form_data.Encode()))
+	orders[3].Recipient = "Jane Doe"
+
+	router, store := setupRouter(orders...)
+
+	_, page := listPage(router, "")
+	assert.Equal(t, pageIDs(page), []string{"1", "2", "3", "4", "5"})
+
+	_, page = listPage(router, "status=OrderProcessing,OrderShipped")
+	assert.Equal(t, pageIDs(page), []string{"2", "3", "4"})
+
+	_, page = listPage(router, "active=false")
+	assert.Equal(t, pageIDs(page), []string{"3"})
+
+	_, page = listPage(router, "recipient=jane+doe")
+	assert.Equal(t, pageIDs(page), []string{"4"})
+
+	_, page = listPage(router, "address=102+example")
+	assert.Equal(t, pageIDs(page), []string{"3"})
+
+	_, page = listPage(router, "createdAfter=2023-09-01T13:00:00Z&createdBefore=2023-09-01T15:00:00Z")
+	assert.Equal(t, pageIDs(page), []string{"2", "3"})
+
+	_, page = listPage(router, "sort=-orderStatus")
+	assert.Equal(t, pageIDs(page), []string{"3", "4", "2", "5", "1"})
+
+	// Walk the pages while an order is added in front of the cursor, it mustn't shift what comes next
+	_, page = listPage(router, "sort=-createdAt&limit=2")
+	assert.Equal(t, pageIDs(page), []string{"5", "4"})
+
+	newest := exampleOrder()
+	newest.ID = "6"
+	newest.CreatedAt = start.Add(24 * time.Hour)
+	store.Create(newest)
+
+	_, page = listPage(router, "sort=-createdAt&limit=2&cursor="+page.NextCursor)
+	assert.Equal(t, pageIDs(page), []string{"3", "2"})
+
+	_, page = listPage(router, "sort=-createdAt&limit=2&cursor="+page.NextCursor)
+	assert.Equal(t, pageIDs(page), []string{"1"})
+	assert.Equal(t, page.NextCursor, "")
+
+	for _, query := range []string{"status=Lost", "active=maybe", "sort=price", "limit=0", "createdAfter=yesterday", "cursor=!!"} {
+		code, _ := listPage(router, query)
+		assert.Equal(t, code, http.StatusBadRequest)
+	}
+
+	// A cursor can't be reused with a different sort order
+	_, page = listPage(router, "limit=1")
+	code, _ := listPage(router, "sort=id&cursor="+page.NextCursor)
+	assert.Equal(t, code, http.StatusBadRequest)
+}
+
+// Sends a JSON request to the router and decodes the JSON response into out
+func sendJSON(router *gin.Engine, method string, target string, body any, out any) *httptest.ResponseRecorder {
+	var reader io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+
+		if err != nil {
+			panic(err)
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, target, reader)
 
 	if err != nil {
 		panic(err)
 	}
 
+	req.Header.Set("Content-Type", "application/json")
+
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	assert.Equal(t, http.StatusLocked, w.Code)
+	if out != nil {
+		json.Unmarshal(w.Body.Bytes(), out)
+	}
 
-	// Test what happens when server recieves an id it doesnt have
+	return w
+}
 
-	orders = []Order{{ID: "1",
-		Active: true, Address: "123 Example Street",
-		Items:       []Item{{Name: "Laptop", Quantity: 1}},
-		Recipient:   "John Doe",
-		OrderStatus: OrderRecieved}}
+func TestV1Routes(t *testing.T) {
+	router, store := setupRouter()
 
-	req, err = http.NewRequest("PATCH", "/update-order-status?id=foo", strings.NewReader(form_data.Encode()))
+	order := exampleOrder()
+	order.ID = ""
 
-	if err != nil {
-		panic(err)
+	var created Order
+
+	w := sendJSON(router, "POST", "/v1/orders", order, &created)
+
+	assert.Equal(t, w.Code, http.StatusCreated)
+
+	location := w.Header().Get("Location")
+
+	var fetched Order
+
+	w = sendJSON(router, "GET", location, nil, &fetched)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, fetched, created)
+
+	var page OrderPage
+
+	sendJSON(router, "GET", "/v1/orders?status=OrderRecieved", nil, &page)
+
+	assert.Equal(t, len(page.Orders), 1)
+
+	var edited Order
+
+	w = sendJSON(router, "PATCH", location, OrderEdit{Recipient: "Jane Doe"}, &edited)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, edited.Recipient, "Jane Doe")
+	assert.Equal(t, edited.Address, "123 Example Street")
+
+	replacement := Order{Address: "240 Park Street", Recipient: "Jane Doe", Items: []Item{{Name: "Desk", UnitPrice: 15000, Quantity: 1}}}
+
+	var replaced Order
+
+	w = sendJSON(router, "PUT", location, replacement, &replaced)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, replaced.Total, int64(15000))
+	assert.Equal(t, replaced.OrderStatus, OrderRecieved)
+
+	replacement.ID = "someone-else"
+
+	w = sendJSON(router, "PUT", location, replacement, nil)
+
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+
+	for _, status := range []Status{OrderProcessing, OrderOutForDelivery} {
+		w = sendJSON(router, "PUT", location+"/status", StatusUpdate{Status: status, ChangeNote: ChangeNote{Actor: "warehouse"}}, nil)
+
+		assert.Equal(t, w.Code, http.StatusAccepted)
 	}
 
-	w = httptest.NewRecorder()
-	router.ServeHTTP(w, req)
+	var completed Order
 
-	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON(router, "POST", location+"/complete", ChangeNote{Actor: "courier", Note: "Left at the door"}, &completed)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, completed.OrderStatus, OrderShipped)
+	assert.Equal(t, completed.StatusHistory[3].Note, "Left at the door")
+	assert.Equal(t, w.Header().Get("Content-Location"), archivedOrderLocation(created.ID))
+
+	// Completed orders move to the archive
+	w = sendJSON(router, "GET", location, nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusNotFound)
+
+	w = sendJSON(router, "GET", archivedOrderLocation(created.ID), nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	w = sendJSON(router, "POST", archivedOrderLocation(created.ID)+"/restore", nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Location"), location)
+
+	w = sendWithHeaders(router, "DELETE", location, nil, adminHeader)
+
+	_, err := store.Get(created.ID)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, err, ErrOrderNotFound)
+}
+
+func TestArchive(t *testing.T) {
+	shipped := exampleOrder()
+	shipped.ID = "2"
+	shipped.OrderStatus = OrderShipped
+	shipped.Active = false
+
+	outForDelivery := exampleOrder()
+	outForDelivery.ID = "3"
+	outForDelivery.OrderStatus = OrderOutForDelivery
+
+	store := NewMemoryStore(exampleOrder(), shipped, outForDelivery)
+	archive := NewMemoryStore()
+
+	api := NewAPI(store)
+	api.archive = archive
+
+	router := gin.Default()
+	api.registerRoutes(router)
+
+	// Orders completed before the archive existed are moved on start up
+	archived, err := api.archiveCompleted()
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, archived, 1)
+
+	w := sendJSON(router, "POST", "/v1/orders/3/complete", nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	var page OrderPage
+
+	sendJSON(router, "GET", "/v1/orders", nil, &page)
+
+	assert.Equal(t, pageIDs(page), []string{"1"})
+
+	sendJSON(router, "GET", "/v1/archive/orders?sort=-id", nil, &page)
+
+	assert.Equal(t, pageIDs(page), []string{"3", "2"})
+
+	// Restored orders are active again and can be returned
+	var restored Order
+
+	w = sendJSON(router, "POST", "/v1/archive/orders/3/restore", nil, &restored)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, restored.Active, true)
+
+	_, err = archive.Get("3")
+
+	assert.Equal(t, err, ErrOrderNotFound)
+
+	w = sendJSON(router, "PUT", "/v1/orders/3/status", StatusUpdate{Status: OrderReturned}, nil)
+
+	assert.Equal(t, w.Code, http.StatusAccepted)
+
+	// An order can't be restored over an active order with the same ID
+	clash := exampleOrder()
+	clash.OrderStatus = OrderShipped
+	archive.Create(clash)
+
+	w = sendJSON(router, "POST", "/v1/archive/orders/1/restore", nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusConflict)
+
+	w = sendJSON(router, "POST", "/v1/archive/orders/9/restore", nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusNotFound)
+
+	// IDs of archived orders can't be reused
+	reused := exampleOrder()
+	reused.ID = "2"
+
+	w = sendJSON(router, "POST", "/v1/orders", reused, nil)
+
+	assert.Equal(t, w.Code, http.StatusConflict)
+
+	// A copy left behind by a move that failed part way is overwritten by the next one
+	interrupted, _ := archive.Get("2")
+	interrupted.Version++
+	store.Create(interrupted)
+
+	archived, err = api.archiveCompleted()
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, archived, 1)
+
+	// But a different order with the same ID is left where it is
+	different := interrupted
+	different.CreatedAt = time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	store.Create(different)
+
+	assert.Equal(t, api.archiveOrder(context.Background(), different), errArchivedOrderExists)
+
+	archived, err = api.archiveCompleted()
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, archived, 0)
+
+	kept, _ := archive.Get("2")
+
+	assert.Equal(t, kept.CreatedAt.IsZero(), true)
+
+	_, err = store.Get("2")
+
+	assert.Equal(t, err, nil)
+}
+
+func TestLegacyRoutesDeprecated(t *testing.T) {
+	router, _ := setupRouter(exampleOrder())
+
+	w := sendJSON(router, "GET", "/get-order?id=1", nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Deprecation"), "@1792195200")
+	assert.Equal(t, w.Header().Get("Sunset"), "Fri, 30 Apr 2027 00:00:00 GMT")
+	assert.Equal(t, w.Header().Get("Link"), `</v1/orders/{id}>; rel="successor-version"`)
+
+	w = sendJSON(router, "GET", "/v1/orders/1", nil, nil)
+
+	assert.Equal(t, w.Header().Get("Deprecation"), "")
+}
+
+func TestRemoveOrder(t *testing.T) {
+	router, store := setupRouter(exampleOrder())
+
+	// Purging is for admins only
+	w := sendWithHeaders(router, "DELETE", "/remove-order?id=1", nil, http.Header{"Authorization": {"Bearer wrong"}})
+
+	assert.Equal(t, w.Code, http.StatusUnauthorized)
+
+	w = sendWithHeaders(router, "DELETE", "/remove-order?id=1", nil, adminHeader)
+
+	var order Order
+
+	json.Unmarshal(w.Body.Bytes(), &order)
+
+	_, err := store.Get("1")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, order.ID, "1")
+	assert.Equal(t, err, ErrOrderNotFound)
+}
+
+func TestCancelOrder(t *testing.T) {
+	outForDelivery := exampleOrder()
+	outForDelivery.ID = "2"
+	outForDelivery.OrderStatus = OrderOutForDelivery
+
+	router, store := setupRouter(exampleOrder(), outForDelivery)
+
+	var problem Problem
+
+	w := sendJSON(router, "POST", "/v1/orders/1/cancel", Cancellation{}, &problem)
+
+	assert.Equal(t, w.Code, http.StatusUnprocessableEntity)
+	assert.Equal(t, problem.Errors[0].Field, "reason")
+
+	var cancelled Order
+
+	w = sendJSON(router, "POST", "/v1/orders/1/cancel", Cancellation{Reason: CancelOutOfStock, ChangeNote: ChangeNote{Actor: "support"}}, &cancelled)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, cancelled.OrderStatus, OrderCancelled)
+	assert.Equal(t, cancelled.Active, false)
+	assert.Equal(t, cancelled.StatusHistory[0].Reason, CancelOutOfStock)
+
+	// Cancelled orders are kept
+	var page OrderPage
+
+	sendJSON(router, "GET", "/v1/orders?status=OrderCancelled", nil, &page)
+
+	assert.Equal(t, pageIDs(page), []string{"1"})
+
+	w = sendJSON(router, "POST", "/v1/orders/1/cancel", Cancellation{Reason: CancelOther}, nil)
+
+	assert.Equal(t, w.Code, http.StatusLocked)
+
+	// Nor can they be edited or replaced
+	w = sendJSON(router, "PATCH", "/v1/orders/1", OrderEdit{Recipient: "Jane Doe"}, nil)
+
+	assert.Equal(t, w.Code, http.StatusLocked)
+
+	w = sendJSON(router, "PUT", "/v1/orders/1", Order{Address: "240 Park Street", Recipient: "Jane Doe", Items: []Item{{Name: "Desk", Quantity: 1}}}, nil)
+
+	assert.Equal(t, w.Code, http.StatusLocked)
+
+	cancelled, _ = store.Get("1")
+
+	assert.Equal(t, cancelled.Recipient, "John Doe")
+	assert.Equal(t, cancelled.Address, "123 Example Street")
+
+	// Orders that have left the warehouse can't be cancelled
+	w = sendJSON(router, "POST", "/v1/orders/2/cancel", Cancellation{Reason: CancelCustomerRequest}, nil)
+
+	stored, _ := store.Get("2")
+
+	assert.Equal(t, w.Code, http.StatusConflict)
+	assert.Equal(t, stored.OrderStatus, OrderOutForDelivery)
+}
+
+func TestCancelThroughStatusUpdate(t *testing.T) {
+	router, store := setupRouter(exampleOrder())
+
+	w := sendJSON(router, "PUT", "/v1/orders/1/status", StatusUpdate{Status: OrderCancelled}, nil)
+
+	assert.Equal(t, w.Code, http.StatusUnprocessableEntity)
+
+	w = sendJSON(router, "PUT", "/v1/orders/1/status", StatusUpdate{Status: OrderCancelled, Reason: "bored"}, nil)
+
+	assert.Equal(t, w.Code, http.StatusUnprocessableEntity)
+
+	w = sendJSON(router, "PUT", "/v1/orders/1/status", StatusUpdate{Status: OrderCancelled, Reason: CancelPaymentFailed}, nil)
+
+	stored, _ := store.Get("1")
+
+	assert.Equal(t, w.Code, http.StatusAccepted)
+	assert.Equal(t, stored.Active, false)
+	assert.Equal(t, stored.StatusHistory[0].Reason, CancelPaymentFailed)
+}
+
+func TestPurgeDisabled(t *testing.T) {
+	store := NewMemoryStore(exampleOrder())
+
+	router := gin.Default()
+	NewAPI(store).registerRoutes(router)
+
+	w := sendWithHeaders(router, "DELETE", "/v1/orders/1", nil, adminHeader)
+
+	_, err := store.Get("1")
+
+	assert.Equal(t, w.Code, http.StatusForbidden)
+	assert.Equal(t, err, nil)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	keys := newTestKeyStore(t)
+
+	key := func(scopes ...Scope) (string, APIKey) {
+		token, key, err := keys.Create("test", scopes)
+
+		if err != nil {
+			panic(err)
+		}
+
+		return token, key
+	}
+
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	readToken, _ := key(ScopeRead)
+	writeToken, _ := key(ScopeWrite)
+	adminToken, _ := key(ScopeAdmin)
+	revokedToken, revoked := key(ScopeAdmin)
+
+	if _, err := keys.Revoke(revoked.ID); err != nil {
+		panic(err)
+	}
+
+	reader, writer, admin := bearer(readToken), bearer(writeToken), bearer(adminToken)
+
+	api := NewAPI(NewMemoryStore(exampleOrder()))
+	api.keys = keys
+	api.requireAPIKey = true
+
+	router := gin.Default()
+	api.registerRoutes(router)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header http.Header
+		code   int
+	}{
+		{"NoKey", "GET", "/v1/orders/1", nil, http.StatusUnauthorized},
+		{"WrongKey", "GET", "/v1/orders/1", http.Header{"Authorization": {"Bearer oa_123_456"}}, http.StatusUnauthorized},
+		{"RevokedKey", "GET", "/v1/orders/1", bearer(revokedToken), http.StatusUnauthorized},
+		{"Read", "GET", "/v1/orders/1", reader, http.StatusOK},
+		{"ReadLegacy", "GET", "/list-orders", reader, http.StatusOK},
+		{"ReadArchive", "GET", "/v1/archive/orders", reader, http.StatusOK},
+		{"WriteWithReadKey", "PUT", "/v1/orders/1/status", reader, http.StatusForbidden},
+		{"ReadWithWriteKey", "GET", "/v1/orders/1", writer, http.StatusForbidden},
+		{"PurgeWithWriteKey", "DELETE", "/v1/orders/1", writer, http.StatusForbidden},
+		{"HeaderKey", "GET", "/v1/orders/1", http.Header{"X-Api-Key": {readToken}}, http.StatusOK},
+		{"AdminReads", "GET", "/v1/orders", admin, http.StatusOK},
+		{"HealthIsOpen", "GET", "/healthz", nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := sendWithHeaders(router, test.method, test.target, nil, test.header)
+
+			assert.Equal(t, w.Code, test.code)
+
+			if test.code == http.StatusUnauthorized {
+				assert.Equal(t, w.Header().Get("WWW-Authenticate"), `Bearer realm="order-api"`)
+			}
+		})
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}, "Authorization": {"Bearer " + writeToken}}
+
+	assert.Equal(t, sendWithHeaders(router, "PUT", "/v1/orders/1/status", strings.NewReader(`{"status":"OrderProcessing"}`), header).Code, http.StatusAccepted)
+	assert.Equal(t, sendWithHeaders(router, "DELETE", "/remove-order?id=1", nil, admin).Code, http.StatusOK)
+}
+
+func TestAPIKeysOptional(t *testing.T) {
+	api := NewAPI(NewMemoryStore(exampleOrder()))
+	api.keys = newTestKeyStore(t)
+
+	router := gin.Default()
+	api.registerRoutes(router)
+
+	// With -require-api-key=false and no keys created yet only admin routes need a credential
+	assert.Equal(t, sendWithHeaders(router, "GET", "/v1/orders/1", nil, nil).Code, http.StatusOK)
+	assert.Equal(t, sendWithHeaders(router, "DELETE", "/v1/orders/1", nil, nil).Code, http.StatusUnauthorized)
+
+	// A key that is sent is still checked
+	assert.Equal(t, sendWithHeaders(router, "GET", "/v1/orders/1", nil, http.Header{"X-Api-Key": {"wrong"}}).Code, http.StatusUnauthorized)
+
+	// Once a key exists a request without one can't do more than it, even after it is revoked
+	_, key, err := api.keys.Create("reader", []Scope{ScopeRead})
+
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, sendWithHeaders(router, "GET", "/v1/orders/1", nil, nil).Code, http.StatusUnauthorized)
+
+	api.keys.Revoke(key.ID)
+
+	assert.Equal(t, sendWithHeaders(router, "GET", "/v1/orders/1", nil, nil).Code, http.StatusUnauthorized)
+}
+
+func TestGetOrderError(t *testing.T) {
+	router, _ := setupRouter(exampleOrder())
+
+	req, err := http.NewRequest("GET", "/get-order?id=5", nil)
+
+	if err != nil {
+		panic(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAddOrderErrors(t *testing.T) {
+	router, _ := setupRouter()
+
+	data := []byte("{870sasdfals: iudsaiofh} /")
+
+	req, err := http.NewRequest("POST", "/add-order", bytes.NewReader(data))
+
+	if err != nil {
+		panic(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var problem Problem
+
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.Equal(t, Problem{
+		Type:     problemTypeBase + codeInvalidJSON,
+		Title:    "Bad Request",
+		Status:   http.StatusBadRequest,
+		Detail:   "Failed to parse JSON",
+		Instance: "/add-order",
+		Code:     codeInvalidJSON,
+	}, problem)
+}
+
+func TestOrderValidation(t *testing.T) {
+	router, store := setupRouter(exampleOrder())
+
+	invalid := map[string]any{
+		"address":     "",
+		"currency":    "DOLLARS",
+		"orderStatus": "Lost",
+		"items": []map[string]any{
+			{"name": "Laptop", "unitPrice": -100, "quantity": 0},
+		},
+	}
+
+	var problem Problem
+
+	w := sendJSON(router, "POST", "/v1/orders", invalid, &problem)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, problem.Code, codeValidationFailed)
+
+	rules := map[string]string{}
+
+	for _, field := range problem.Errors {
+		rules[field.Field] = field.Rule
+	}
+
+	assert.Equal(t, rules, map[string]string{
+		"address":            "required",
+		"recipient":          "required",
+		"currency":           "iso4217",
+		"orderStatus":        "status",
+		"items[0].unitPrice": "min",
+		"items[0].quantity":  "gt",
+	})
+
+	// Orders need at least one item
+	empty := exampleOrder()
+	empty.ID = ""
+	empty.Items = []Item{}
+
+	problem = Problem{}
+	w = sendJSON(router, "POST", "/v1/orders", empty, &problem)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, problem.Errors, FieldErrors{{Field: "items", Rule: "min", Message: "length must be at least 1"}})
+
+	// Client picked IDs have to be usable in a URL as they are
+	for _, id := range []string{"a/b", " ", "a b", "..", "café", "x?y"} {
+		bad := exampleOrder()
+		bad.ID = id
+
+		problem = Problem{}
+		w = sendJSON(router, "POST", "/v1/orders", bad, &problem)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Equal(t, problem.Errors[0].Field, "id")
+		assert.Equal(t, problem.Errors[0].Rule, "orderid")
+	}
+
+	good := exampleOrder()
+	good.ID = "Order-2.b_~"
+
+	w = sendJSON(router, "POST", "/v1/orders", good, nil)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, w.Header().Get("Location"), "/v1/orders/Order-2.b_~")
+	assert.Equal(t, sendJSON(router, "GET", w.Header().Get("Location"), nil, nil).Code, http.StatusOK)
+
+	store.Delete(good.ID, func(Order) error { return nil })
+
+	// Edits are checked too and leave the order alone when they fail
+	problem = Problem{}
+	w = sendJSON(router, "PATCH", "/v1/orders/1", OrderEdit{Recipient: strings.Repeat("a", 201)}, &problem)
+
+	stored, _ := store.Get("1")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, problem.Errors[0].Field, "recipient")
+	assert.Equal(t, stored.Recipient, "John Doe")
+
+	orders, _ := store.List()
+
+	assert.Equal(t, len(orders), 1)
+}
+
+// Posts an order with an Idempotency-Key header
+func postWithKey(router *gin.Engine, key string, order Order) *httptest.ResponseRecorder {
+	data, err := json.Marshal(order)
+
+	if err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", "/v1/orders", bytes.NewReader(data))
+
+	if err != nil {
+		panic(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyHeader, key)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.json")
+	store := NewMemoryStore()
+
+	newIdempotentRouter := func() (*gin.Engine, *IdempotencyStore) {
+		idempotency, err := NewIdempotencyStore(path, time.Hour, 0)
+
+		if err != nil {
+			panic(err)
+		}
+
+		api := NewAPI(store)
+		api.idempotency = idempotency
+
+		router := gin.Default()
+		api.registerRoutes(router)
+
+		return router, idempotency
+	}
+
+	router, _ := newIdempotentRouter()
+
+	order := exampleOrder()
+	order.ID = ""
+
+	first := postWithKey(router, "key-1", order)
+	retry := postWithKey(router, "key-1", order)
+
+	assert.Equal(t, first.Code, http.StatusCreated)
+	assert.Equal(t, retry.Code, http.StatusCreated)
+	assert.Equal(t, retry.Body.String(), first.Body.String())
+	assert.Equal(t, retry.Header().Get("Location"), first.Header().Get("Location"))
+	assert.Equal(t, retry.Header().Get(idempotencyReplayedHeader), "true")
+
+	orders, _ := store.List()
+
+	assert.Equal(t, len(orders), 1)
+
+	// The same key can't be used for a different order
+	other := order
+	other.Recipient = "Jane Doe"
+
+	w := postWithKey(router, "key-1", other)
+
+	assert.Equal(t, w.Code, http.StatusUnprocessableEntity)
+
+	// Keys are remembered across a restart
+	router, idempotency := newIdempotentRouter()
+
+	retry = postWithKey(router, "key-1", order)
+
+	assert.Equal(t, retry.Body.String(), first.Body.String())
+
+	// and forgotten once they expire
+	idempotency.now = func() time.Time {
+		return time.Now().Add(2 * time.Hour)
+	}
+
+	w = postWithKey(router, "key-1", order)
+
+	assert.Equal(t, w.Code, http.StatusCreated)
+	assert.NotEqual(t, w.Body.String(), first.Body.String())
+
+	orders, _ = store.List()
+
+	assert.Equal(t, len(orders), 2)
+}
+
+func TestIdempotencyKeysPerClient(t *testing.T) {
+	idempotency, err := NewIdempotencyStore(filepath.Join(t.TempDir(), "idempotency.json"), time.Hour, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer idempotency.Close()
+
+	store := NewMemoryStore()
+
+	api := NewAPI(store)
+	api.keys = newTestKeyStore(t)
+	api.idempotency = idempotency
+
+	router := gin.Default()
+	api.registerRoutes(router)
+
+	order := exampleOrder()
+	order.ID = ""
+
+	data, _ := json.Marshal(order)
+
+	post := func(scopes ...Scope) *httptest.ResponseRecorder {
+		token, _, err := api.keys.Create("client", scopes)
+
+		if err != nil {
+			panic(err)
+		}
+
+		header := http.Header{
+			"Authorization":   {"Bearer " + token},
+			"Content-Type":    {"application/json"},
+			"Idempotency-Key": {"shared"},
+		}
+
+		return sendWithHeaders(router, "POST", "/v1/orders", bytes.NewReader(data), header)
+	}
+
+	// Two clients that happen to pick the same key each get their own order
+	first := post(ScopeWrite)
+	second := post(ScopeWrite)
+
+	assert.Equal(t, first.Code, http.StatusCreated)
+	assert.Equal(t, second.Code, http.StatusCreated)
+	assert.Equal(t, second.Header().Get(idempotencyReplayedHeader), "")
+	assert.NotEqual(t, second.Header().Get("Location"), first.Header().Get("Location"))
+
+	orders, _ := store.List()
+
+	assert.Equal(t, len(orders), 2)
+}
+
+func TestIdempotencyJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.json")
+
+	open := func() *IdempotencyStore {
+		store, err := NewIdempotencyStore(path, time.Hour, 0)
+
+		if err != nil {
+			panic(err)
+		}
+
+		return store
+	}
+
+	save := func(store *IdempotencyStore, key string, created time.Time) {
+		if _, err := store.begin(key, "fingerprint"); err != nil {
+			panic(err)
+		}
+
+		if err := store.finish(key, &idempotencyRecord{Fingerprint: "fingerprint", Status: http.StatusCreated, CreatedAt: created}); err != nil {
+			panic(err)
+		}
+	}
+
+	store := open()
+	save(store, "old", time.Now().Add(-2*time.Hour))
+	save(store, "new", time.Now())
+
+	// Records are appended to the journal rather than rewriting the snapshot
+	_, err := os.Stat(path)
+
+	assert.Equal(t, errors.Is(err, os.ErrNotExist), true)
+	assert.NotEqual(t, store.journal.size, int64(0))
+
+	// and replayed from it after a restart
+	reopened := open()
+	record, _ := reopened.begin("new", "fingerprint")
+
+	assert.NotEqual(t, record, nil)
+	assert.Equal(t, reopened.Close(), nil)
+
+	// Compacting writes a snapshot without the expired records and empties the journal
+	assert.Equal(t, store.Close(), nil)
+
+	journal, err := os.ReadFile(journalPath(path))
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(journal), 0)
+
+	var snapshot map[string]idempotencyRecord
+
+	data, _ := os.ReadFile(path)
+
+	assert.Equal(t, json.Unmarshal(data, &snapshot), nil)
+	assert.Equal(t, len(snapshot), 1)
+	assert.Equal(t, snapshot["new"].Status, http.StatusCreated)
+}
+
+// Sends a request with the given headers
+func sendWithHeaders(router *gin.Engine, method string, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, target, body)
+
+	if err != nil {
+		panic(err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestOrderETags(t *testing.T) {
+	router, store := setupRouter(exampleOrder())
+
+	w := sendWithHeaders(router, "GET", "/v1/orders/1", nil, nil)
+	etag := w.Header().Get("ETag")
+
+	assert.Equal(t, etag, `"1"`)
+
+	// Polling with the ETag costs nothing while the order is unchanged
+	w = sendWithHeaders(router, "GET", "/v1/orders/1", nil, http.Header{"If-None-Match": {etag}})
+
+	assert.Equal(t, w.Code, http.StatusNotModified)
+	assert.Equal(t, w.Body.Len(), 0)
+
+	edit := func(recipient string, ifMatch string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(OrderEdit{Recipient: recipient})
+
+		return sendWithHeaders(router, "PATCH", "/v1/orders/1", bytes.NewReader(body), http.Header{
+			"Content-Type": {"application/json"},
+			"If-Match":     {ifMatch},
+		})
+	}
+
+	// The first agent's edit goes through and changes the ETag
+	w = edit("Jane Doe", etag)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("ETag"), `"2"`)
+
+	// The second agent read the order before that edit so theirs is turned away
+	w = edit("Jean Doe", etag)
+
+	stored, _ := store.Get("1")
+
+	assert.Equal(t, w.Code, http.StatusPreconditionFailed)
+	assert.Equal(t, stored.Recipient, "Jane Doe")
+
+	w = sendWithHeaders(router, "GET", "/v1/orders/1", nil, http.Header{"If-None-Match": {etag}})
+
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	w = sendWithHeaders(router, "PUT", "/v1/orders/1/status", strings.NewReader(`{"status": "OrderProcessing"}`), http.Header{
+		"Content-Type": {"application/json"},
+		"If-Match":     {etag},
+	})
+
+	assert.Equal(t, w.Code, http.StatusPreconditionFailed)
+
+	w = sendWithHeaders(router, "DELETE", "/v1/orders/1", nil, http.Header{"If-Match": {etag}, "Authorization": adminHeader["Authorization"]})
+
+	assert.Equal(t, w.Code, http.StatusPreconditionFailed)
+
+	w = sendWithHeaders(router, "DELETE", "/v1/orders/1", nil, http.Header{"If-Match": {`"2"`}, "Authorization": adminHeader["Authorization"]})
+
+	assert.Equal(t, w.Code, http.StatusOK)
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	store := NewMemoryStore(exampleOrder())
+
+	api := NewAPI(store)
+	api.requireIfMatch = true
+
+	router := gin.Default()
+	api.registerRoutes(router)
+
+	w := sendWithHeaders(router, "POST", "/v1/orders/1/complete", nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusPreconditionRequired)
+
+	w = sendWithHeaders(router, "PATCH", "/v1/orders/1", strings.NewReader(`{"address": "1 Main Street"}`), http.Header{
+		"Content-Type": {"application/json"},
+		"If-Match":     {"*"},
+	})
+
+	assert.Equal(t, w.Code, http.StatusOK)
+}
+
+func TestUpdateOrderStatusErrors(t *testing.T) {
+	inactive := exampleOrder()
+	inactive.Active = false
+
+	router, _ := setupRouter(inactive)
+
+	form_data := url.Values{
+		"status": {"3"},
+	}
+
+	req, err := http.NewRequest("PATCH", "/update-order-status?id=1", strings.NewReader(form_data.Encode()))
+
+	if err != nil {
+		panic(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusLocked, w.Code)
+
+	// Test what happens when server recieves an id it doesnt have
+
+	router, _ = setupRouter(exampleOrder())
+
+	req, err = http.NewRequest("PATCH", "/update-order-status?id=foo", strings.NewReader(form_data.Encode()))
+
+	if err != nil {
+		panic(err)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+}
+
+// Sends a request to the router and returns the status code
+func send(router *gin.Engine, method string, target string, body io.Reader, contentType string) int {
+	req, err := http.NewRequest(method, target, body)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w.Code
+}
+
+// Runs go test -race to catch unsynchronized access to the orders
+func TestConcurrentRequests(t *testing.T) {
+	store, err := NewJSONFileStore(setupDatabaseFile(t), 512)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer store.Close()
+
+	stores := map[string]OrderStore{
+		"memory": NewMemoryStore(),
+		"json":   store,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			router := newRouter(store)
+
+			const workers = 8
+			const iterations = 24
+
+			var wg sync.WaitGroup
+
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+
+				go func(w int) {
+					defer wg.Done()
+
+					for i := 0; i < iterations; i++ {
+						order := exampleOrder()
+						order.ID = fmt.Sprintf("%d-%d", w, i)
+
+						data, _ := json.Marshal(order)
+						form := url.Values{"address": {"240 Park Street"}, "status": {string(OrderProcessing)}}.Encode()
+
+						send(router, "POST", "/add-order", bytes.NewReader(data), "application/json")
+						send(router, "GET", "/get-order?id="+order.ID, nil, "")
+						send(router, "PATCH", "/edit-order?id="+order.ID, strings.NewReader(form), "application/x-www-form-urlencoded")
+						send(router, "PATCH", "/update-order-status?id="+order.ID, strings.NewReader(form), "application/x-www-form-urlencoded")
+						send(router, "GET", "/", nil, "")
+
+						// Remove every other order so deletes race with everything else too
+						if i%2 == 0 {
+							sendWithHeaders(router, "DELETE", "/remove-order?id="+order.ID, nil, adminHeader)
+						}
+					}
+				}(w)
+			}
+
+			wg.Wait()
+
+			orders, _ := store.List()
+
+			assert.Equal(t, len(orders), workers*iterations/2)
+
+			for _, order := range orders {
+				assert.Equal(t, order.Address, "240 Park Street")
+				assert.Equal(t, order.OrderStatus, OrderProcessing)
+			}
+		})
+	}
+}
+
+func TestHealthRoutes(t *testing.T) {
+	path := setupDatabaseFile(t)
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer store.Close()
+
+	router := newRouter(store)
+
+	var health HealthResponse
+
+	w := sendJSON(router, "GET", "/healthz", nil, &health)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, health.Status, "ok")
+
+	w = sendJSON(router, "GET", "/readyz", nil, &health)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, health, HealthResponse{Status: "ok", Checks: map[string]string{"orders": "ok", "archive": "ok"}})
+
+	active := exampleOrder()
+	inactive := exampleOrder()
+	inactive.ID = "2"
+	inactive.Active = false
+	inactive.OrderStatus = OrderCancelled
+
+	assert.Equal(t, store.Create(active), nil)
+	assert.Equal(t, store.Create(inactive), nil)
+
+	var status StatusResponse
+
+	w = sendJSON(router, "GET", "/status", nil, &status)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, status.Status, "ok")
+	assert.Equal(t, status.Orders, OrderCounts{Total: 2, Active: 1, Inactive: 1, ByStatus: map[Status]int{OrderRecieved: 1, OrderCancelled: 1}})
+	assert.Equal(t, status.Archived, OrderCounts{ByStatus: map[Status]int{}})
+	assert.Equal(t, status.Storage.Orders.Backend, "json")
+	assert.Equal(t, status.Storage.Orders.Path, path)
+	assert.Equal(t, *status.Storage.Orders.JournalBytes > 0, true)
+	assert.Equal(t, status.Storage.Archive.Backend, "memory")
+
+	// Once a write fails the instance stops being ready but is still alive
+	store.journal.file.Close()
+
+	order := exampleOrder()
+	order.ID = "3"
+
+	w = sendJSON(router, "POST", "/v1/orders", order, nil)
+
+	assert.Equal(t, w.Code, http.StatusInternalServerError)
+
+	w = sendJSON(router, "GET", "/readyz", nil, &health)
+
+	assert.Equal(t, w.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, health.Status, "unavailable")
+	assert.NotEqual(t, health.Checks["orders"], "ok")
+	assert.Equal(t, health.Checks["archive"], "ok")
+
+	w = sendJSON(router, "GET", "/status", nil, &status)
+
+	assert.Equal(t, w.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, status.Status, "unavailable")
+
+	w = sendJSON(router, "GET", "/healthz", nil, nil)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+}
+
+// Fetches the metrics an API's router serves
+func scrapeMetrics(router *gin.Engine) string {
+	req, err := http.NewRequest("GET", "/metrics", nil)
+
+	if err != nil {
+		panic(err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		panic(w.Body.String())
+	}
+
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	path := setupDatabaseFile(t)
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer store.Close()
+
+	api := NewAPI(store)
+	api.metrics.observeStore("orders", store)
+
+	router := gin.New()
+	router.Use(api.metrics.middleware())
+	api.registerRoutes(router)
+
+	assert.Equal(t, sendJSON(router, "POST", "/v1/orders", exampleOrder(), nil).Code, http.StatusCreated)
+	assert.Equal(t, sendJSON(router, "GET", "/v1/orders/1", nil, nil).Code, http.StatusOK)
+	assert.Equal(t, sendJSON(router, "GET", "/v1/orders/2", nil, nil).Code, http.StatusNotFound)
+	assert.Equal(t, sendJSON(router, "GET", "/nowhere", nil, nil).Code, http.StatusNotFound)
+
+	assert.Equal(t, store.compact(), nil)
+
+	metrics := scrapeMetrics(router)
+
+	for _, line := range []string{
+		`order_api_http_requests_total{method="POST",route="/v1/orders",status="201"} 1`,
+		`order_api_http_requests_total{method="GET",route="/v1/orders/:id",status="200"} 1`,
+		`order_api_http_requests_total{method="GET",route="/v1/orders/:id",status="404"} 1`,
+		`order_api_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`order_api_http_request_duration_seconds_count{method="GET",route="/v1/orders/:id"} 2`,
+		`order_api_orders{status="OrderRecieved",store="orders"} 1`,
+		`order_api_orders{status="OrderShipped",store="orders"} 0`,
+		`order_api_orders{status="OrderRecieved",store="archive"} 0`,
+		`order_api_orders_active{active="true",store="orders"} 1`,
+		`order_api_orders_active{active="false",store="orders"} 0`,
+		`order_api_storage_writes_total{kind="journal",store="orders"} 1`,
+		`order_api_storage_writes_total{kind="snapshot",store="orders"} 1`,
+		`order_api_storage_write_duration_seconds_count{kind="snapshot",store="orders"} 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics are missing %s", line)
+		}
+	}
+
+	// Failed writes are counted separately
+	store.journal.file.Close()
+
+	order := exampleOrder()
+	order.ID = "2"
+
+	assert.Equal(t, sendJSON(router, "POST", "/v1/orders", order, nil).Code, http.StatusInternalServerError)
+
+	metrics = scrapeMetrics(router)
+
+	assert.Equal(t, strings.Contains(metrics, `order_api_storage_writes_total{kind="journal",store="orders"} 2`+"\n"), true)
+	assert.Equal(t, strings.Contains(metrics, `order_api_storage_write_failures_total{kind="journal",store="orders"} 1`+"\n"), true)
+	assert.Equal(t, strings.Contains(metrics, `order_api_http_requests_total{method="POST",route="/v1/orders",status="500"} 1`+"\n"), true)
+}
+
+// Creates an API whose router is set up like the server's and whose logs go to the returned buffer as JSON
+func setupLoggedRouter(orders ...Order) (*gin.Engine, *bytes.Buffer) {
+	var logs bytes.Buffer
+
+	logger, err := newLogger(&logs, "debug", "json")
+
+	if err != nil {
+		panic(err)
+	}
+
+	api := NewAPI(NewMemoryStore(orders...))
+	api.logger = logger
+	api.adminToken = testAdminToken
+
+	return api.router(defaultConfig()), &logs
+}
+
+// Decodes every JSON log line
+func logEntries(logs *bytes.Buffer) []map[string]any {
+	var entries []map[string]any
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			panic(err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestRequestIDs(t *testing.T) {
+	router, logs := setupLoggedRouter(exampleOrder())
+
+	// A request ID from the client is kept
+	w := sendWithHeaders(router, "GET", "/v1/orders/1", nil, http.Header{"X-Request-Id": {"client-id-1"}})
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("X-Request-ID"), "client-id-1")
+
+	entries := logEntries(logs)
+
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0]["msg"], "Request handled")
+	assert.Equal(t, entries[0]["requestId"], "client-id-1")
+	assert.Equal(t, entries[0]["route"], "/v1/orders/:id")
+	assert.Equal(t, entries[0]["status"], float64(http.StatusOK))
+
+	// Missing and unsafe IDs are replaced with generated ones
+	for _, id := range []string{"", "has spaces", strings.Repeat("a", maxRequestIDLength+1)} {
+		header := http.Header{}
+
+		if id != "" {
+			header.Set("X-Request-ID", id)
+		}
+
+		w = sendWithHeaders(router, "GET", "/v1/orders/1", nil, header)
+
+		_, err := uuid.Parse(w.Header().Get("X-Request-ID"))
+
+		assert.Equal(t, err, nil)
+	}
+}
+
+func TestOrderEventLogs(t *testing.T) {
+	router, logs := setupLoggedRouter()
+
+	header := http.Header{"X-Request-Id": {"create"}}
+	data, _ := json.Marshal(exampleOrder())
+
+	assert.Equal(t, sendWithHeaders(router, "POST", "/v1/orders", bytes.NewReader(data), header).Code, http.StatusCreated)
+	assert.Equal(t, sendJSON(router, "PUT", "/v1/orders/1/status", StatusUpdate{Status: OrderProcessing}, nil).Code, http.StatusAccepted)
+	assert.Equal(t, sendJSON(router, "PUT", "/v1/orders/1/status", StatusUpdate{Status: OrderOutForDelivery}, nil).Code, http.StatusAccepted)
+	assert.Equal(t, sendJSON(router, "PATCH", "/v1/orders/1", OrderEdit{Address: "456 Example Avenue"}, nil).Code, http.StatusOK)
+	assert.Equal(t, sendJSON(router, "POST", "/v1/orders/1/complete", nil, nil).Code, http.StatusOK)
+	assert.Equal(t, sendJSON(router, "POST", "/v1/archive/orders/1/restore", nil, nil).Code, http.StatusOK)
+	assert.Equal(t, sendWithHeaders(router, "DELETE", "/v1/orders/1", nil, adminHeader).Code, http.StatusOK)
+
+	var events []map[string]any
+
+	for _, entry := range logEntries(logs) {
+		if entry["msg"] != "Request handled" {
+			events = append(events, entry)
+		}
+	}
+
+	messages := []string{}
+
+	for _, event := range events {
+		messages = append(messages, event["msg"].(string))
+		assert.Equal(t, event["orderId"], "1")
+		assert.NotEqual(t, event["requestId"], nil)
+	}
+
+	assert.Equal(t, messages, []string{"Order created", "Order status changed", "Order status changed", "Order edited", "Order completed", "Order restored", "Order removed"})
+	assert.Equal(t, events[0]["requestId"], "create")
+	assert.Equal(t, events[0]["status"], string(OrderRecieved))
+	assert.Equal(t, events[2]["from"], string(OrderProcessing))
+	assert.Equal(t, events[2]["to"], string(OrderOutForDelivery))
+}
+
+func TestRouterProblems(t *testing.T) {
+	router := NewAPI(NewMemoryStore()).router(defaultConfig())
+
+	var problem Problem
+
+	w := sendJSON(router, "GET", "/v2/orders", nil, &problem)
+
+	assert.Equal(t, w.Code, http.StatusNotFound)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/problem+json")
+	assert.Equal(t, problem.Code, codeRouteNotFound)
+	assert.Equal(t, problem.Instance, "/v2/orders")
+
+	w = sendJSON(router, "PATCH", "/v1/orders", nil, &problem)
+
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/problem+json")
+	assert.Equal(t, w.Header().Get("Allow"), "GET, POST")
+	assert.Equal(t, problem.Code, codeMethodNotAllowed)
+}
+
+func TestRecoveryLogsPanics(t *testing.T) {
+	var logs bytes.Buffer
+
+	logger, err := newLogger(&logs, "info", "json")
+
+	if err != nil {
+		panic(err)
+	}
+
+	api := NewAPI(NewMemoryStore())
+	api.logger = logger
+
+	router := api.router(defaultConfig())
+	router.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	w := sendWithHeaders(router, "GET", "/panic", nil, http.Header{"X-Request-Id": {"panicky"}})
+
+	var problem Problem
+
+	json.Unmarshal(w.Body.Bytes(), &problem)
+
+	assert.Equal(t, w.Code, http.StatusInternalServerError)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/problem+json")
+	assert.Equal(t, problem.Code, codeInternal)
+
+	entries := logEntries(&logs)
+
+	assert.Equal(t, entries[0]["msg"], "Request panicked")
+	assert.Equal(t, entries[0]["requestId"], "panicky")
+	assert.Equal(t, entries[1]["msg"], "Request handled")
+	assert.Equal(t, entries[1]["level"], "ERROR")
+
+	// Panics are counted as server errors
+	assert.Equal(t, strings.Contains(scrapeMetrics(router), `order_api_http_requests_total{method="GET",route="/panic",status="500"} 1`), true)
+}
+
+// Creates an API whose router is set up like the server's and whose spans are kept in the returned recorder
+func setupTracedRouter(orders ...Order) (*gin.Engine, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+
+	api := NewAPI(NewMemoryStore(orders...))
+	api.tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	return api.router(defaultConfig()), recorder
+}
+
+// Returns the names of the spans in the order they ended
+func spanNames(spans []sdktrace.ReadOnlySpan) []string {
+	names := []string{}
+
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+
+	return names
+}
+
+func TestTracing(t *testing.T) {
+	delivering := exampleOrder()
+	delivering.ID = "3"
+	delivering.OrderStatus = OrderOutForDelivery
+
+	router, recorder := setupTracedRouter(delivering)
+
+	// The trace the client started is continued
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	header := http.Header{"Traceparent": {"00-" + traceID + "-00f067aa0ba902b7-01"}}
+
+	data, _ := json.Marshal(exampleOrder())
+
+	assert.Equal(t, sendWithHeaders(router, "POST", "/v1/orders", bytes.NewReader(data), header).Code, http.StatusCreated)
+
+	spans := recorder.Ended()
+
+	// The archive is checked first so the new order can't take an archived order's ID
+	assert.Equal(t, spanNames(spans), []string{"bind", "store.Get", "store.Create", "POST /v1/orders"})
+	assert.Equal(t, spans[1].Attributes()[0], attribute.String("order.store", "archive"))
+
+	request := spans[3]
+
+	assert.Equal(t, request.SpanContext().TraceID().String(), traceID)
+	assert.Equal(t, request.Parent().SpanID().String(), "00f067aa0ba902b7")
+
+	for _, span := range spans[:3] {
+		assert.Equal(t, span.Parent().SpanID(), request.SpanContext().SpanID())
+	}
+
+	assert.Equal(t, spans[2].Attributes(), []attribute.KeyValue{
+		attribute.String("order.store", "orders"),
+		attribute.String("order.store.backend", "memory"),
+		attribute.String("order.id", "1"),
+	})
+
+	// Failed storage operations are marked as errors
+	assert.Equal(t, sendJSON(router, "GET", "/v1/orders/2", nil, nil).Code, http.StatusNotFound)
+
+	spans = recorder.Ended()[4:]
+
+	assert.Equal(t, spanNames(spans), []string{"store.Get", "GET /v1/orders/:id"})
+	assert.Equal(t, spans[0].Status().Code, codes.Error)
+	assert.Equal(t, spans[0].Status().Description, ErrOrderNotFound.Error())
+
+	// Completing touches both stores
+	assert.Equal(t, sendJSON(router, "PUT", "/v1/orders/1", exampleOrder(), nil).Code, http.StatusOK)
+	assert.Equal(t, sendJSON(router, "POST", "/v1/orders/3/complete", nil, nil).Code, http.StatusOK)
+
+	spans = recorder.Ended()[6:]
+
+	assert.Equal(t, spanNames(spans), []string{
+		"bind", "store.Update", "PUT /v1/orders/:id",
+		"store.Update", "store.Create", "store.Delete", "POST /v1/orders/:id/complete",
+	})
+	assert.Equal(t, spans[4].Attributes()[0], attribute.String("order.store", "archive"))
+}
+
+func TestStdoutTraceExporter(t *testing.T) {
+	config := defaultConfig()
+	config.TracingExporter = "stdout"
+	config.TracingFile = filepath.Join(t.TempDir(), "traces.json")
+
+	provider, shutdown, err := newTracerProvider(config)
+
+	if err != nil {
+		panic(err)
+	}
+
+	api := NewAPI(NewMemoryStore(exampleOrder()))
+	api.tracerProvider = provider
+
+	router := api.router(config)
+
+	assert.Equal(t, sendJSON(router, "GET", "/v1/orders/1", nil, nil).Code, http.StatusOK)
+
+	// Spans are batched until the provider is shut down
+	assert.Equal(t, shutdown(context.Background()), nil)
+
+	data, err := os.ReadFile(config.TracingFile)
 
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(string(data), `"Name":"store.Get"`), true)
+	assert.Equal(t, strings.Contains(string(data), `"Name":"GET /v1/orders/:id"`), true)
+	assert.Equal(t, strings.Contains(string(data), `"Value":"order-api"`), true)
 }
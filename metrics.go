@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prefix of every metric the API exports
+const metricsNamespace = "order_api"
+
+// Metrics holds the Prometheus metrics of an API. Each API has its own registry so
+// several can exist side by side, as they do in the tests
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	storageWrites        *prometheus.CounterVec
+	storageWriteFailures *prometheus.CounterVec
+	storageWriteDuration *prometheus.HistogramVec
+}
+
+// Creates the metrics for an API, including gauges of the orders in its stores
+func newMetrics(api *API) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests handled by route, method and status code.",
+		}, []string{"method", "route", "status"}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+
+		storageWrites: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_writes_total",
+			Help:      "Number of writes to disk by store and kind of write, including failed ones.",
+		}, []string{"store", "kind"}),
+
+		storageWriteFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_write_failures_total",
+			Help:      "Number of writes to disk that failed by store and kind of write.",
+		}, []string{"store", "kind"}),
+
+		storageWriteDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_write_duration_seconds",
+			Help:      "Time taken by writes to disk by store and kind of write.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"store", "kind"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.storageWrites,
+		m.storageWriteFailures,
+		m.storageWriteDuration,
+		orderCollector{api},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Counts every request and how long it took. Requests that didn't match a route are
+// grouped together so unknown URLs can't create new series
+func (m *Metrics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+
+		if route == "" {
+			route = "unmatched"
+		}
+
+		m.requests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		m.requestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(started).Seconds())
+	}
+}
+
+// Serves the metrics in the Prometheus text format
+func (m *Metrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// Records the writes a store makes to disk under the given name. Stores that don't write
+// to disk are left alone
+func (m *Metrics) observeStore(name string, store OrderStore) {
+	observable, ok := store.(WriteObservable)
+
+	if !ok {
+		return
+	}
+
+	observable.ObserveWrites(func(kind string, took time.Duration, err error) {
+		m.storageWrites.WithLabelValues(name, kind).Inc()
+		m.storageWriteDuration.WithLabelValues(name, kind).Observe(took.Seconds())
+
+		if err != nil {
+			m.storageWriteFailures.WithLabelValues(name, kind).Inc()
+		}
+	})
+}
+
+var (
+	ordersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "orders"),
+		"Number of orders by store and status.",
+		[]string{"store", "status"}, nil,
+	)
+
+	activeOrdersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "orders_active"),
+		"Number of active and inactive orders by store.",
+		[]string{"store", "active"}, nil,
+	)
+)
+
+// Reports the number of orders in the API's stores whenever the metrics are scraped, so
+// the counts can never drift from what is actually stored
+type orderCollector struct {
+	api *API
+}
+
+func (o orderCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ordersDesc
+	ch <- activeOrdersDesc
+}
+
+func (o orderCollector) Collect(ch chan<- prometheus.Metric) {
+	stores := map[string]OrderStore{"orders": o.api.store, "archive": o.api.archive}
+
+	for name, store := range stores {
+		counts, err := countOrders(store)
+
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(ordersDesc, err)
+			continue
+		}
+
+		// Report every status so a status dropping to zero doesn't just disappear
+		for _, status := range allStatuses {
+			ch <- prometheus.MustNewConstMetric(ordersDesc, prometheus.GaugeValue, float64(counts.ByStatus[status]), name, string(status))
+		}
+
+		ch <- prometheus.MustNewConstMetric(activeOrdersDesc, prometheus.GaugeValue, float64(counts.Active), name, "true")
+		ch <- prometheus.MustNewConstMetric(activeOrdersDesc, prometheus.GaugeValue, float64(counts.Inactive), name, "false")
+	}
+}
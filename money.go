@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// Currency used for orders that don't name one, including every order saved before
+// prices carried a currency
+const defaultCurrency = "USD"
+
+// ISO 4217 currencies whose minor unit isn't a hundredth of the major unit
+var currencyExponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+// Returns how many minor units make up one major unit of the currency, 100 for most
+func minorUnits(currency string) int64 {
+	exponent, ok := currencyExponents[currency]
+
+	if !ok {
+		exponent = 2
+	}
+
+	return int64(math.Pow10(exponent))
+}
+
+// Converts a price in major units, as stored before prices were integers, to minor units
+func toMinorUnits(price float64, currency string) int64 {
+	return int64(math.Round(price * float64(minorUnits(currency))))
+}
+
+// Highest unit price an item can have, in minor units. Along with the limits on quantities
+// and items it keeps every total well inside an int64
+const maxUnitPrice = 1_000_000_000_000
+
+// Returned when an order's subtotals or total don't fit in an int64
+var errTotalOverflow = FieldErrors{{Field: "total", Rule: "max", Message: "is too large, lower the unit prices or quantities"}}
+
+// Multiplies two amounts, reporting false if the result overflows
+func mulAmount(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+
+	product := a * b
+
+	if product/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+
+	return product, true
+}
+
+// Adds two amounts, reporting false if the result overflows
+func addAmount(a, b int64) (int64, bool) {
+	sum := a + b
+
+	if (sum > a) != (b > 0) {
+		return 0, false
+	}
+
+	return sum, true
+}
+
+// Fills in the default currency and recalculates the item subtotals and the order total.
+// Returns errTotalOverflow rather than a wrapped around total if they don't fit in an int64
+func (o *Order) computeTotals() error {
+	if o.Currency == "" {
+		o.Currency = defaultCurrency
+	}
+
+	var total int64
+
+	for i := range o.Items {
+		subtotal, ok := mulAmount(o.Items[i].UnitPrice, int64(o.Items[i].Quantity))
+
+		if !ok {
+			return errTotalOverflow
+		}
+
+		if total, ok = addAmount(total, subtotal); !ok {
+			return errTotalOverflow
+		}
+
+		o.Items[i].Subtotal = subtotal
+	}
+
+	o.Total = total
+
+	return nil
+}
+
+// Accepts the old float "price" field alongside "unitPrice". The price is converted
+// once the order it belongs to has been decoded and its currency is known
+func (i *Item) UnmarshalJSON(data []byte) error {
+	type item Item
+
+	var decoded struct {
+		item
+		Price *float64 `json:"price"`
+	}
+
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*i = Item(decoded.item)
+	i.legacyPrice = decoded.Price
+
+	return nil
+}
+
+// Converts any old float prices on the order's items to minor units of its currency
+func (o *Order) UnmarshalJSON(data []byte) error {
+	type order Order
+
+	if err := json.Unmarshal(data, (*order)(o)); err != nil {
+		return err
+	}
+
+	currency := o.Currency
+
+	if currency == "" {
+		currency = defaultCurrency
+	}
+
+	for i := range o.Items {
+		if o.Items[i].legacyPrice != nil {
+			if o.Items[i].UnitPrice == 0 {
+				o.Items[i].UnitPrice = toMinorUnits(*o.Items[i].legacyPrice, currency)
+			}
+
+			o.Items[i].legacyPrice = nil
+		}
+	}
+
+	// An order whose total overflows is rejected by the handler that decoded it, which
+	// recalculates the totals itself
+	o.computeTotals()
+
+	// Orders saved before they had versions start at the first one
+	if o.Version == 0 {
+		o.Version = 1
+	}
+
+	return nil
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"time"
+)
+
 // swagger:enum Status
 type Status string
 
@@ -8,20 +13,143 @@ const (
 	OrderProcessing     Status = "OrderProcessing"
 	OrderOutForDelivery Status = "OrderOutForDelivery"
 	OrderShipped        Status = "OrderShipped"
+	OrderCancelled      Status = "OrderCancelled"
+	OrderReturned       Status = "OrderReturned"
+)
+
+// Every status an order can be in
+var allStatuses = []Status{OrderRecieved, OrderProcessing, OrderOutForDelivery, OrderShipped, OrderCancelled, OrderReturned}
+
+// The statuses an order is allowed to move to from each status. Orders move forward
+// through the normal flow and can drop out of it by being cancelled before they leave
+// the warehouse or returned once they are on their way
+var statusTransitions = map[Status][]Status{
+	OrderRecieved:       {OrderProcessing, OrderCancelled},
+	OrderProcessing:     {OrderOutForDelivery, OrderCancelled},
+	OrderOutForDelivery: {OrderShipped, OrderReturned},
+	OrderShipped:        {OrderReturned},
+	OrderCancelled:      {},
+	OrderReturned:       {},
+}
+
+// Why an order was cancelled
+// swagger:enum CancelReason
+type CancelReason string
+
+const (
+	CancelCustomerRequest CancelReason = "customer_request"
+	CancelOutOfStock      CancelReason = "out_of_stock"
+	CancelPaymentFailed   CancelReason = "payment_failed"
+	CancelFraudSuspected  CancelReason = "fraud_suspected"
+	CancelDuplicateOrder  CancelReason = "duplicate_order"
+	CancelOther           CancelReason = "other"
 )
 
+// Every reason an order can be cancelled for
+var cancelReasons = []CancelReason{CancelCustomerRequest, CancelOutOfStock, CancelPaymentFailed, CancelFraudSuspected, CancelDuplicateOrder, CancelOther}
+
+// Reports whether r is one of the known cancellation reasons
+func (r CancelReason) Valid() bool {
+	for _, reason := range cancelReasons {
+		if r == reason {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reports whether s is one of the known statuses
+func (s Status) Valid() bool {
+	_, ok := statusTransitions[s]
+	return ok
+}
+
+// Returns the statuses an order in status s can move to
+func (s Status) Next() []Status {
+	return statusTransitions[s]
+}
+
+// Reports whether an order in status s may move to next
+func (s Status) CanTransitionTo(next Status) bool {
+	for _, allowed := range statusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returned when an order is asked to move to a status it can't reach from its current one
+type TransitionError struct {
+	From    Status   `json:"from"`
+	To      Status   `json:"to"`
+	Allowed []Status `json:"allowed"`
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order can't move from %s to %s", e.From, e.To)
+}
+
+// Moves the order to change.Status if the transition table allows it and records the change
+func (o *Order) transition(change StatusChange) error {
+	if !o.OrderStatus.CanTransitionTo(change.Status) {
+		return &TransitionError{From: o.OrderStatus, To: change.Status, Allowed: o.OrderStatus.Next()}
+	}
+
+	o.OrderStatus = change.Status
+	o.StatusHistory = append(o.StatusHistory, change)
+	o.UpdatedAt = change.Timestamp
+
+	// Cancelled orders stay around for the record but can't be changed any more
+	if change.Status == OrderCancelled {
+		o.Active = false
+	}
+
+	return nil
+}
+
+// An entry in an order's status history
+type StatusChange struct {
+	Status    Status    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	// Why the order was cancelled, only set on the change to OrderCancelled
+	Reason CancelReason `json:"reason,omitempty"`
+}
+
 type Item struct {
-	Name     string  `json:"name"`
-	Price    float32 `json:"price"`
-	Quantity int     `json:"quantity"`
+	Name string `json:"name" validate:"required,max=200"`
+	// Price of a single unit in minor units of the order's currency, e.g. cents
+	UnitPrice int64 `json:"unitPrice" validate:"min=0,max=1000000000000"`
+	Quantity  int   `json:"quantity" validate:"gt=0,max=10000"`
+	// UnitPrice times Quantity, calculated by the server
+	Subtotal int64 `json:"subtotal"`
+
+	// Float price read from an order saved before prices were integers
+	legacyPrice *float64
 }
 
 // swagger:model
 type Order struct {
-	ID          string `json:"id"`
+	ID          string `json:"id" validate:"max=128,orderid"`
 	Active      bool   `json:"active"`
-	Items       []Item `json:"items"`
-	Address     string `json:"address"`
-	Recipient   string `json:"recipient"`
-    OrderStatus Status `json:"orderStatus"`
+	Items       []Item `json:"items" validate:"required,min=1,max=100,dive"`
+	Address     string `json:"address" validate:"required,max=500"`
+	Recipient   string `json:"recipient" validate:"required,max=200"`
+	OrderStatus Status `json:"orderStatus" validate:"omitempty,status"`
+
+	// Starts at 1 and goes up every time the order changes. Sent as the ETag of the order
+	Version int64 `json:"version"`
+
+	// ISO 4217 code of the currency every price on the order is in, USD if left out
+	Currency string `json:"currency" validate:"omitempty,iso4217"`
+	// Sum of the item subtotals, calculated by the server
+	Total int64 `json:"total"`
+
+	CreatedAt     time.Time      `json:"createdAt"`
+	UpdatedAt     time.Time      `json:"updatedAt"`
+	StatusHistory []StatusChange `json:"statusHistory"`
 }
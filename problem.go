@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Where the problem types are documented. Each code is an anchor in that page
+const problemTypeBase = "https://github.com/grqphical07/order-api/blob/main/docs/problems.md#"
+
+// Machine readable codes for every kind of error the API returns
+const (
+	codeInvalidJSON       = "invalid-json"
+	codeInvalidBody       = "invalid-body"
+	codeInvalidQuery      = "invalid-query"
+	codeIDMismatch        = "id-mismatch"
+	codeOrderNotFound     = "order-not-found"
+	codeOrderExists       = "order-exists"
+	codeOrderInactive     = "order-inactive"
+	codeUnknownStatus     = "unknown-status"
+	codeInvalidTransition = "invalid-transition"
+	codeValidationFailed  = "validation-failed"
+
+	codeUnauthorized = "unauthorized"
+	codeForbidden    = "forbidden"
+
+	codePreconditionFailed   = "precondition-failed"
+	codePreconditionRequired = "precondition-required"
+
+	codeIdempotencyKeyInUse  = "idempotency-key-in-use"
+	codeIdempotencyKeyReused = "idempotency-key-reused"
+	codeStorageFailure       = "storage-failure"
+
+	codeRouteNotFound    = "route-not-found"
+	codeMethodNotAllowed = "method-not-allowed"
+	codeInternal         = "internal-error"
+)
+
+// Problem is an RFC 7807 problem details object. Every error response from the API is one
+type Problem struct {
+	// URI of the page describing this kind of problem
+	Type string `json:"type"`
+	// Short summary of the kind of problem, the same for every occurrence
+	Title string `json:"title"`
+	// HTTP status code
+	Status int `json:"status"`
+	// Explanation specific to this occurrence
+	Detail string `json:"detail,omitempty"`
+	// Path of the request that caused the problem
+	Instance string `json:"instance,omitempty"`
+	// Machine readable error code
+	Code string `json:"code"`
+
+	// Status the order is in, for invalid-transition problems
+	CurrentStatus Status `json:"currentStatus,omitempty"`
+	// Statuses the order can move to, for invalid-transition problems
+	AllowedStatuses []Status `json:"allowedStatuses,omitempty"`
+	// Every field that broke a rule, for validation-failed problems
+	Errors FieldErrors `json:"errors,omitempty"`
+}
+
+// A field in a request body that broke one of the validation rules
+type FieldError struct {
+	// Path of the field, e.g. items[0].quantity
+	Field string `json:"field"`
+	// Name of the rule that failed, e.g. required or max
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// The fields of a request body that failed validation
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	messages := make([]string, len(e))
+
+	for i, field := range e {
+		messages[i] = field.Field + " " + field.Message
+	}
+
+	return strings.Join(messages, ", ")
+}
+
+func (p *Problem) Error() string {
+	return p.Detail
+}
+
+// Creates a problem. The title is the standard text for the status code
+func newProblem(status int, code string, detail string) *Problem {
+	return &Problem{
+		Type:   problemTypeBase + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Writes a problem as an application/problem+json response and stops the handler chain
+func writeProblem(c *gin.Context, p *Problem) {
+	if p.Instance == "" {
+		p.Instance = c.Request.URL.Path
+	}
+
+	// c.JSON only sets the content type if there isn't one already
+	c.Header("Content-Type", "application/problem+json")
+	c.AbortWithStatusJSON(p.Status, p)
+}
+
+// Answers requests for URLs that don't match any route
+func routeNotFound(c *gin.Context) {
+	writeProblem(c, newProblem(http.StatusNotFound, codeRouteNotFound, fmt.Sprintf("No route matches '%s'", c.Request.URL.Path)))
+}
+
+// Answers requests for a route that exists but not with the request's method. Gin has
+// already listed the methods the route does take in the Allow header
+func methodNotAllowed(c *gin.Context) {
+	writeProblem(c, newProblem(http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("Method %s isn't allowed on '%s'", c.Request.Method, c.Request.URL.Path)))
+}
+
+// Converts an error from a store or an update function into a problem and writes it
+func writeError(c *gin.Context, id string, err error) {
+	var problem *Problem
+	var unknown *unknownStatusError
+	var transition *TransitionError
+	var fields FieldErrors
+
+	switch {
+	case errors.As(err, &problem):
+	case errors.Is(err, ErrOrderNotFound):
+		problem = newProblem(http.StatusNotFound, codeOrderNotFound, fmt.Sprintf("Order with id '%s' not found", id))
+	case errors.Is(err, ErrOrderExists):
+		problem = newProblem(http.StatusConflict, codeOrderExists, fmt.Sprintf("Order with id '%s' already exists", id))
+	case errors.Is(err, errOrderInactive):
+		problem = newProblem(http.StatusLocked, codeOrderInactive, "Order is no longer active")
+	case errors.As(err, &unknown):
+		problem = newProblem(http.StatusBadRequest, codeUnknownStatus, unknown.Error())
+	case errors.As(err, &transition):
+		problem = newProblem(http.StatusConflict, codeInvalidTransition, transitionDetail(transition))
+		problem.CurrentStatus = transition.From
+		problem.AllowedStatuses = transition.Allowed
+	case errors.Is(err, errPreconditionFailed):
+		problem = newProblem(http.StatusPreconditionFailed, codePreconditionFailed, "Order has changed since it was read, fetch it again and retry")
+	case errors.Is(err, errPreconditionRequired):
+		problem = newProblem(http.StatusPreconditionRequired, codePreconditionRequired, "Changes to an order must send the order's ETag in an If-Match header")
+	case errors.As(err, &fields):
+		problem = newProblem(http.StatusUnprocessableEntity, codeValidationFailed, "Request body failed validation: "+fields.Error())
+		problem.Errors = fields
+	default:
+		problem = newProblem(http.StatusInternalServerError, codeStorageFailure, "Failed to access the order database")
+	}
+
+	writeProblem(c, problem)
+}
+
+// Explains a rejected status change, listing what the order could move to instead
+func transitionDetail(e *TransitionError) string {
+	if len(e.Allowed) == 0 {
+		return fmt.Sprintf("Order can't move from %s to %s, %s is a final status", e.From, e.To, e.From)
+	}
+
+	return fmt.Sprintf("Order can't move from %s to %s, it can only move to %v", e.From, e.To, e.Allowed)
+}
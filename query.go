@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Turns an order into a string that sorts the same way as the field it is sorting by
+type sortKey func(order Order) string
+
+// The fields orders can be sorted by
+var sortKeys = map[string]sortKey{
+	"id": func(order Order) string {
+		return order.ID
+	},
+	"createdAt": func(order Order) string {
+		// Fixed width so the strings compare like the times
+		return order.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000000Z")
+	},
+	"orderStatus": func(order Order) string {
+		// Sort by position in the order flow rather than alphabetically
+		for i, status := range allStatuses {
+			if status == order.OrderStatus {
+				return fmt.Sprintf("%03d", i)
+			}
+		}
+
+		return "999"
+	},
+	"active": func(order Order) string {
+		return strconv.FormatBool(order.Active)
+	},
+	"recipient": func(order Order) string {
+		return strings.ToLower(order.Recipient)
+	},
+	"address": func(order Order) string {
+		return strings.ToLower(order.Address)
+	},
+}
+
+// Filters, sort order and page position for listing orders
+type OrderQuery struct {
+	Statuses      []Status
+	Active        *bool
+	Recipient     string
+	Address       string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	Sort       string
+	Descending bool
+	Limit      int
+	After      *listCursor
+}
+
+// Position of the last order on a page. It is handed to clients as an opaque string
+type listCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d"`
+	Key        string `json:"k"`
+	ID         string `json:"i"`
+}
+
+func (c listCursor) encode() string {
+	data, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Returned when a list query can't be understood
+var errInvalidCursor = errors.New("invalid cursor")
+
+func decodeCursor(s string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	var c listCursor
+
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// Reads an OrderQuery from the query string of a list request
+func parseOrderQuery(values url.Values) (OrderQuery, error) {
+	q := OrderQuery{Sort: "createdAt", Limit: defaultPageSize}
+
+	for _, param := range values["status"] {
+		for _, s := range strings.Split(param, ",") {
+			status := Status(s)
+
+			if !status.Valid() {
+				return q, fmt.Errorf("unknown status '%s'", s)
+			}
+
+			q.Statuses = append(q.Statuses, status)
+		}
+	}
+
+	if s := values.Get("active"); s != "" {
+		active, err := strconv.ParseBool(s)
+
+		if err != nil {
+			return q, fmt.Errorf("active must be true or false")
+		}
+
+		q.Active = &active
+	}
+
+	q.Recipient = values.Get("recipient")
+	q.Address = values.Get("address")
+
+	for name, dst := range map[string]*time.Time{"createdAfter": &q.CreatedAfter, "createdBefore": &q.CreatedBefore} {
+		if s := values.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+
+			*dst = t
+		}
+	}
+
+	if s := values.Get("sort"); s != "" {
+		q.Descending = strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+
+		if _, ok := sortKeys[q.Sort]; !ok {
+			return q, fmt.Errorf("can't sort by '%s'", q.Sort)
+		}
+	}
+
+	if s := values.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+
+		q.Limit = limit
+	}
+
+	if s := values.Get("cursor"); s != "" {
+		cursor, err := decodeCursor(s)
+
+		if err != nil {
+			return q, err
+		}
+
+		// A cursor only makes sense for the ordering it came from
+		if cursor.Sort != q.Sort || cursor.Descending != q.Descending {
+			return q, fmt.Errorf("cursor was created for a different sort order")
+		}
+
+		q.After = cursor
+	}
+
+	return q, nil
+}
+
+// Reports whether the order passes every filter in the query
+func (q OrderQuery) matches(order Order) bool {
+	if len(q.Statuses) > 0 {
+		found := false
+
+		for _, status := range q.Statuses {
+			if order.OrderStatus == status {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if q.Active != nil && order.Active != *q.Active {
+		return false
+	}
+
+	if q.Recipient != "" && !strings.EqualFold(order.Recipient, q.Recipient) {
+		return false
+	}
+
+	if q.Address != "" && !strings.Contains(strings.ToLower(order.Address), strings.ToLower(q.Address)) {
+		return false
+	}
+
+	if !q.CreatedAfter.IsZero() && order.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+
+	if !q.CreatedBefore.IsZero() && !order.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// Returns the orders in store that match the filters in q, using the store's indexes when it has them
+func findOrders(store OrderStore, q OrderQuery) ([]Order, error) {
+	if finder, ok := store.(OrderFinder); ok {
+		return finder.Find(q)
+	}
+
+	return store.List()
+}
+
+// A page of orders from a list request
+type OrderPage struct {
+	Orders []Order `json:"orders"`
+	// Pass as the cursor parameter to get the next page. Left out on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Filters, sorts and pages the orders. Pages are keyed on the sort value and ID of the last
+// order returned, so orders added while a client is paging don't shift later pages around
+func (q OrderQuery) apply(orders []Order) OrderPage {
+	key := sortKeys[q.Sort]
+
+	type keyed struct {
+		order Order
+		key   string
+	}
+
+	var matched []keyed
+
+	for _, order := range orders {
+		if q.matches(order) {
+			matched = append(matched, keyed{order: order, key: key(order)})
+		}
+	}
+
+	// Compares two positions in the listing, negative when a comes first
+	compare := func(aKey, aID, bKey, bID string) int {
+		c := strings.Compare(aKey, bKey)
+
+		if c == 0 {
+			c = strings.Compare(aID, bID)
+		}
+
+		if q.Descending {
+			c = -c
+		}
+
+		return c
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return compare(matched[i].key, matched[i].order.ID, matched[j].key, matched[j].order.ID) < 0
+	})
+
+	start := 0
+
+	if q.After != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return compare(matched[i].key, matched[i].order.ID, q.After.Key, q.After.ID) > 0
+		})
+	}
+
+	end := start + q.Limit
+
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := OrderPage{Orders: []Order{}}
+
+	for _, m := range matched[start:end] {
+		page.Orders = append(page.Orders, m.order)
+	}
+
+	if end < len(matched) {
+		last := matched[end-1]
+		page.NextCursor = listCursor{Sort: q.Sort, Descending: q.Descending, Key: last.key, ID: last.order.ID}.encode()
+	}
+
+	return page
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+)
+
+// When the RPC style routes were deprecated and when they will stop working
+var (
+	legacyDeprecatedAt = time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)
+	legacySunsetAt     = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// Creates the server's router with its middleware, the docs enabled in config and every order route
+func (api *API) router(config Config) *gin.Engine {
+	router := gin.New()
+
+	// Every log line about a request carries its ID and the ID of its trace
+	router.Use(api.tracing(), api.requestID(), api.accessLog())
+
+	// Outside the recovery middleware so requests that panic are counted as the 500s they end up as
+	if api.metrics != nil {
+		router.Use(api.metrics.middleware())
+	}
+
+	router.Use(api.recovery())
+
+	if config.Swagger {
+		router.StaticFile("/docs/swagger.json", config.SwaggerFile)
+
+		router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.URL("/docs/swagger.json")))
+	}
+
+	api.registerRoutes(router)
+
+	// Errors from the router itself are problems like every other error
+	router.HandleMethodNotAllowed = true
+	router.NoRoute(routeNotFound)
+	router.NoMethod(methodNotAllowed)
+
+	return router
+}
+
+// Registers every order route on the router
+func (api *API) registerRoutes(router gin.IRouter) {
+	router.GET("/", api.index)
+
+	// Checks for load balancers and orchestrators
+	router.GET("/healthz", api.healthz)
+	router.GET("/readyz", api.readyz)
+	router.GET("/status", api.status)
+
+	if api.metrics != nil {
+		router.GET("/metrics", api.metrics.handler())
+	}
+
+	v1 := router.Group("/v1")
+
+	read := api.requireScope(ScopeRead)
+	write := api.requireScope(ScopeWrite)
+	admin := api.requireScope(ScopeAdmin)
+
+	v1.POST("/orders", write, api.idempotent(), api.addOrder)
+	v1.GET("/orders", read, api.listOrders)
+	v1.GET("/orders/:id", read, api.getOrder)
+	v1.PUT("/orders/:id", write, api.replaceOrder)
+	v1.PATCH("/orders/:id", write, api.editOrder)
+	v1.DELETE("/orders/:id", admin, api.purgeOrder)
+	v1.PUT("/orders/:id/status", write, api.updateOrderStatus)
+	v1.POST("/orders/:id/complete", write, api.completeOrder)
+	v1.POST("/orders/:id/cancel", write, api.cancelOrder)
+
+	v1.GET("/archive/orders", read, api.listArchivedOrders)
+	v1.GET("/archive/orders/:id", read, api.getArchivedOrder)
+	v1.POST("/archive/orders/:id/restore", write, api.restoreOrder)
+
+	// The original routes keep working until the sunset date but point clients at their replacements
+	router.POST("/add-order", deprecated("/v1/orders"), write, api.idempotent(), api.addOrder)
+	router.GET("/get-order", deprecated("/v1/orders/{id}"), read, api.getOrder)
+	router.GET("/list-orders", deprecated("/v1/orders"), read, api.listOrders)
+	router.PATCH("/update-order-status", deprecated("/v1/orders/{id}/status"), write, api.updateOrderStatus)
+	router.DELETE("/remove-order", deprecated("/v1/orders/{id}"), admin, api.purgeOrder)
+	router.PATCH("/complete-order", deprecated("/v1/orders/{id}/complete"), write, api.completeOrder)
+	router.PATCH("/edit-order", deprecated("/v1/orders/{id}"), write, api.editOrder)
+}
+
+// Marks responses from a legacy route as deprecated (RFC 9745) with the date it goes away (RFC 8594)
+// and a link to the route that replaces it
+func deprecated(successor string) gin.HandlerFunc {
+	deprecation := "@" + strconv.FormatInt(legacyDeprecatedAt.Unix(), 10)
+	sunset := legacySunsetAt.Format(http.TimeFormat)
+	link := "<" + successor + `>; rel="successor-version"`
+
+	return func(c *gin.Context) {
+		c.Header("Deprecation", deprecation)
+		c.Header("Sunset", sunset)
+		c.Header("Link", link)
+		c.Next()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// Starts serving a handler that blocks until release is closed. Returns the server's address,
+// a channel that is sent to when a request reaches the handler and one with serve's result
+func startBlockingServer(ctx context.Context, release chan struct{}, timeout time.Duration) (string, chan struct{}, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		panic(err)
+	}
+
+	started := make(chan struct{}, 1)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		io.WriteString(w, "done")
+	})}
+
+	result := make(chan error, 1)
+
+	go func() {
+		result <- serve(ctx, server, listener, timeout)
+	}()
+
+	return "http://" + listener.Addr().String(), started, result
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+
+	url, started, result := startBlockingServer(ctx, release, 5*time.Second)
+
+	responses := make(chan string, 1)
+
+	go func() {
+		resp, err := http.Get(url)
+
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+
+	<-started
+	cancel()
+
+	// New connections are refused as soon as shutdown starts
+	for {
+		conn, err := net.Dial("tcp", url[len("http://"):])
+
+		if err != nil {
+			break
+		}
+
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-result:
+		t.Fatalf("serve returned before the request finished: %v", err)
+	default:
+	}
+
+	close(release)
+
+	assert.Equal(t, <-responses, "done")
+	assert.Equal(t, <-result, nil)
+}
+
+func TestServeShutdownDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+
+	url, started, result := startBlockingServer(ctx, release, 50*time.Millisecond)
+
+	go http.Get(url)
+
+	<-started
+	cancel()
+
+	assert.Equal(t, errors.Is(<-result, context.DeadlineExceeded), true)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by an OrderStore when no order matches the requested ID
+var ErrOrderNotFound = errors.New("order not found")
+
+// Returned by an OrderStore when creating an order whose ID is already taken
+var ErrOrderExists = errors.New("order already exists")
+
+// OrderStore is the storage backend the API handlers read and write orders through
+type OrderStore interface {
+	// Get returns the order with the given ID
+	Get(id string) (Order, error)
+
+	// List returns every order in the store in insertion order
+	List() ([]Order, error)
+
+	// Create adds a new order to the store or returns ErrOrderExists if the ID is taken.
+	// Orders without a version are given version 1, moved orders keep theirs
+	Create(order Order) error
+
+	// Update calls fn with the order matching id and saves whatever fn leaves behind with
+	// its version bumped. If fn returns an error nothing is saved and the error is passed
+	// back to the caller
+	Update(id string, fn func(order *Order) error) (Order, error)
+
+	// Delete removes the order with the given ID and returns it. If check isn't nil it is
+	// called with the order first and nothing is deleted if it returns an error
+	Delete(id string, check func(order Order) error) (Order, error)
+
+	// Close releases whatever resources the store holds
+	Close() error
+}
+
+// OrderFinder is implemented by stores that can find the orders matching a query's filters
+// without the caller going through every order
+type OrderFinder interface {
+	// Find returns the orders matching the filters in q in any order
+	Find(q OrderQuery) ([]Order, error)
+}
+
+// OrderCounter is implemented by stores that can count their orders without listing them
+type OrderCounter interface {
+	// Count returns how many orders there are in each status and how many are active
+	Count() (OrderCounts, error)
+}
+
+// StoreChecker is implemented by stores whose storage can stop working while they are open
+type StoreChecker interface {
+	// Check returns an error if the store can't currently read or save orders
+	Check() error
+}
+
+// StoreDescriber is implemented by stores that can say where they keep their orders
+type StoreDescriber interface {
+	// Describe returns the backend and location of the store
+	Describe() StoreInfo
+}
+
+// Called by a store after each write it makes to disk with the kind of write, how long it
+// took and why it failed, if it did
+type WriteObserver func(kind string, took time.Duration, err error)
+
+// WriteObservable is implemented by stores that write to disk and can report each write
+type WriteObservable interface {
+	// ObserveWrites sets the function called after every write
+	ObserveWrites(observer WriteObserver)
+}
+
+// Where a store keeps its orders
+type StoreInfo struct {
+	Backend string `json:"backend"`
+	Path    string `json:"path,omitempty"`
+	// Size of the JSON journal waiting to be folded into the database file
+	JournalBytes *int64 `json:"journalBytes,omitempty"`
+}
+
+// MemoryStore keeps orders in memory only. It is mainly used by the tests.
+// It is safe to use from multiple goroutines
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	// Every order in insertion order
+	orders *list.List
+
+	// Indexes into orders. Every order is in byID and in one set of each secondary index
+	byID        map[string]*list.Element
+	byStatus    map[Status]orderSet
+	byActive    map[bool]orderSet
+	byRecipient map[string]orderSet
+}
+
+// A set of orders in a MemoryStore keyed by ID
+type orderSet map[string]*list.Element
+
+// Creates a MemoryStore seeded with the given orders
+func NewMemoryStore(orders ...Order) *MemoryStore {
+	s := &MemoryStore{
+		orders:      list.New(),
+		byID:        map[string]*list.Element{},
+		byStatus:    map[Status]orderSet{},
+		byActive:    map[bool]orderSet{},
+		byRecipient: map[string]orderSet{},
+	}
+
+	for _, order := range orders {
+		order = cloneOrder(order)
+		order.computeTotals()
+
+		if order.Version == 0 {
+			order.Version = 1
+		}
+
+		s.insert(order)
+	}
+
+	return s
+}
+
+func (s *MemoryStore) Get(id string) (Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.byID[id]
+
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+
+	return cloneOrder(e.Value.(Order)), nil
+}
+
+func (s *MemoryStore) List() ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := make([]Order, 0, s.orders.Len())
+
+	for e := s.orders.Front(); e != nil; e = e.Next() {
+		orders = append(orders, cloneOrder(e.Value.(Order)))
+	}
+
+	return orders, nil
+}
+
+// The indexes narrow the search down so only orders that might match are checked
+func (s *MemoryStore) Find(q OrderQuery) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var candidates []orderSet
+
+	if len(q.Statuses) > 0 {
+		union := orderSet{}
+
+		for _, status := range q.Statuses {
+			for id, e := range s.byStatus[status] {
+				union[id] = e
+			}
+		}
+
+		candidates = append(candidates, union)
+	}
+
+	if q.Active != nil {
+		candidates = append(candidates, s.byActive[*q.Active])
+	}
+
+	if q.Recipient != "" {
+		candidates = append(candidates, s.byRecipient[recipientKey(q.Recipient)])
+	}
+
+	if len(candidates) == 0 {
+		candidates = append(candidates, s.byID)
+	}
+
+	// Scan the smallest set, q.matches checks the other filters
+	smallest := candidates[0]
+
+	for _, set := range candidates[1:] {
+		if len(set) < len(smallest) {
+			smallest = set
+		}
+	}
+
+	var orders []Order
+
+	for _, e := range smallest {
+		order := e.Value.(Order)
+
+		if q.matches(order) {
+			orders = append(orders, cloneOrder(order))
+		}
+	}
+
+	return orders, nil
+}
+
+// The counts come straight from the sizes of the indexes
+func (s *MemoryStore) Count() (OrderCounts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := OrderCounts{
+		Total:    s.orders.Len(),
+		Active:   len(s.byActive[true]),
+		Inactive: len(s.byActive[false]),
+		ByStatus: map[Status]int{},
+	}
+
+	for status, set := range s.byStatus {
+		if len(set) > 0 {
+			counts.ByStatus[status] = len(set)
+		}
+	}
+
+	return counts, nil
+}
+
+func (s *MemoryStore) Describe() StoreInfo {
+	return StoreInfo{Backend: "memory"}
+}
+
+func (s *MemoryStore) Create(order Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byID[order.ID]; ok {
+		return ErrOrderExists
+	}
+
+	order = cloneOrder(order)
+
+	if err := order.computeTotals(); err != nil {
+		return err
+	}
+
+	if order.Version == 0 {
+		order.Version = 1
+	}
+
+	s.insert(order)
+
+	return nil
+}
+
+func (s *MemoryStore) Update(id string, fn func(order *Order) error) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.byID[id]
+
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+
+	// Work on a copy so a failed update leaves the stored order untouched
+	order := cloneOrder(e.Value.(Order))
+
+	if err := fn(&order); err != nil {
+		return Order{}, err
+	}
+
+	if err := order.computeTotals(); err != nil {
+		return Order{}, err
+	}
+
+	order.Version++
+	s.replace(e, order)
+
+	return cloneOrder(order), nil
+}
+
+func (s *MemoryStore) Delete(id string, check func(order Order) error) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.byID[id]
+
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+
+	order := e.Value.(Order)
+
+	if check != nil {
+		if err := check(cloneOrder(order)); err != nil {
+			return Order{}, err
+		}
+	}
+
+	s.remove(e)
+
+	return order, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Recipients are matched case insensitively so they are indexed by their lower case form
+func recipientKey(recipient string) string {
+	return strings.ToLower(recipient)
+}
+
+// Adds an order to the end of the store and its indexes. Callers must hold s.mu
+func (s *MemoryStore) insert(order Order) {
+	e := s.orders.PushBack(order)
+
+	s.byID[order.ID] = e
+	s.index(e)
+}
+
+// Swaps the order held in e for order and moves it between indexes to match. Callers must hold s.mu
+func (s *MemoryStore) replace(e *list.Element, order Order) {
+	s.unindex(e)
+	delete(s.byID, e.Value.(Order).ID)
+
+	e.Value = order
+
+	s.byID[order.ID] = e
+	s.index(e)
+}
+
+// Removes the order held in e from the store and its indexes. Callers must hold s.mu
+func (s *MemoryStore) remove(e *list.Element) {
+	s.unindex(e)
+	delete(s.byID, e.Value.(Order).ID)
+	s.orders.Remove(e)
+}
+
+// Adds the order held in e to the secondary indexes. Callers must hold s.mu
+func (s *MemoryStore) index(e *list.Element) {
+	order := e.Value.(Order)
+
+	addToIndex(s.byStatus, order.OrderStatus, order.ID, e)
+	addToIndex(s.byActive, order.Active, order.ID, e)
+	addToIndex(s.byRecipient, recipientKey(order.Recipient), order.ID, e)
+}
+
+// Removes the order held in e from the secondary indexes. Callers must hold s.mu
+func (s *MemoryStore) unindex(e *list.Element) {
+	order := e.Value.(Order)
+
+	removeFromIndex(s.byStatus, order.OrderStatus, order.ID)
+	removeFromIndex(s.byActive, order.Active, order.ID)
+	removeFromIndex(s.byRecipient, recipientKey(order.Recipient), order.ID)
+}
+
+// Adds an order to the set for key in a secondary index
+func addToIndex[K comparable](index map[K]orderSet, key K, id string, e *list.Element) {
+	set, ok := index[key]
+
+	if !ok {
+		set = orderSet{}
+		index[key] = set
+	}
+
+	set[id] = e
+}
+
+// Removes an order from the set for key in a secondary index
+func removeFromIndex[K comparable](index map[K]orderSet, key K, id string) {
+	delete(index[key], id)
+
+	// Drop empty sets so keys that are no longer used, like old recipients, don't pile up
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
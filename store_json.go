@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Journal operations. Creates and updates both carry the full order so replaying them is
+// just an upsert, which keeps replay safe if a compaction was interrupted half way
+const (
+	journalCreate = "create"
+	journalUpdate = "update"
+	journalDelete = "delete"
+)
+
+// A single mutation recorded in the journal
+type journalEntry struct {
+	Op    string    `json:"op"`
+	ID    string    `json:"id"`
+	Order *Order    `json:"order,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// JSONFileStore keeps every order in memory. Each change is appended to a journal file
+// and the journal is periodically folded into a fresh snapshot of the JSON database
+type JSONFileStore struct {
+	*MemoryStore
+	path string
+
+	// Guards the journal and the snapshot file. Every write holds it for its whole
+	// duration so the journal order always matches the order changes were made in
+	mu      sync.Mutex
+	journal *journal
+	// Why the last write to the journal or snapshot failed, nil once a write or a check
+	// succeeds again
+	writeErr error
+	// Told about every journal append and snapshot, may be nil
+	observer WriteObserver
+}
+
+// Loads the JSON database at path, replays its journal and starts compacting the journal
+// in the background whenever it grows past maxJournalSize bytes. A maxJournalSize of zero
+// or less disables automatic compaction. A database that doesn't exist yet starts out empty
+func NewJSONFileStore(path string, maxJournalSize int64) (*JSONFileStore, error) {
+	if err := recoverDatabase(path); err != nil {
+		return nil, err
+	}
+
+	var orders []Order
+
+	data, err := os.ReadFile(path)
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &orders); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &JSONFileStore{
+		MemoryStore: NewMemoryStore(orders...),
+		path:        path,
+	}
+
+	// The store isn't shared yet so entries can be applied without holding mu
+	s.journal, err = openJournal(path, maxJournalSize, func(data []byte) error {
+		var entry journalEntry
+
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+
+		s.apply(entry)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	go s.journal.compactor(s.compact)
+
+	return s, nil
+}
+
+// Applies a journal entry to the orders in memory. Only used before the store is shared
+func (s *JSONFileStore) apply(entry journalEntry) {
+	e, exists := s.byID[entry.ID]
+
+	switch entry.Op {
+	case journalCreate, journalUpdate:
+		if entry.Order == nil {
+			return
+		}
+
+		if exists {
+			s.replace(e, *entry.Order)
+		} else {
+			s.insert(*entry.Order)
+		}
+	case journalDelete:
+		if exists {
+			s.remove(e)
+		}
+	}
+}
+
+// Appends an entry to the journal and flushes it to disk. Must be called with s.mu held
+func (s *JSONFileStore) appendJournal(op string, id string, order *Order) error {
+	started := time.Now()
+	err := s.journal.append(journalEntry{Op: op, ID: id, Order: order, Time: time.Now().UTC()})
+
+	s.observe("journal", started, err)
+	s.writeErr = err
+
+	return err
+}
+
+func (s *JSONFileStore) Create(order Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.MemoryStore.Get(order.ID); err == nil {
+		return ErrOrderExists
+	}
+
+	if order.Version == 0 {
+		order.Version = 1
+	}
+
+	if err := s.appendJournal(journalCreate, order.ID, &order); err != nil {
+		return err
+	}
+
+	return s.MemoryStore.Create(order)
+}
+
+func (s *JSONFileStore) Update(id string, fn func(order *Order) error) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.MemoryStore.Update(id, func(order *Order) error {
+		if err := fn(order); err != nil {
+			return err
+		}
+
+		// The update is only kept in memory if it made it into the journal. Journal the
+		// order with the version MemoryStore.Update is about to give it
+		saved := cloneOrder(*order)
+		saved.Version++
+
+		return s.appendJournal(journalUpdate, id, &saved)
+	})
+}
+
+func (s *JSONFileStore) Delete(id string, check func(order Order) error) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, err := s.MemoryStore.Get(id)
+
+	if err != nil {
+		return Order{}, err
+	}
+
+	if check != nil {
+		if err := check(order); err != nil {
+			return Order{}, err
+		}
+	}
+
+	if err := s.appendJournal(journalDelete, id, nil); err != nil {
+		return Order{}, err
+	}
+
+	return s.MemoryStore.Delete(id, nil)
+}
+
+func (s *JSONFileStore) ObserveWrites(observer WriteObserver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observer = observer
+}
+
+// Reports a write that started at started to the observer. Must be called with s.mu held
+func (s *JSONFileStore) observe(kind string, started time.Time, err error) {
+	if s.observer != nil {
+		s.observer(kind, time.Since(started), err)
+	}
+}
+
+// Fails if the journal hasn't been replayed or the journal or the database's directory can't
+// be written to. A write that failed earlier only counts while writing still fails
+func (s *JSONFileStore) Check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil {
+		return errors.New("journal hasn't been replayed")
+	}
+
+	if err := s.journal.probe(); err != nil {
+		if s.writeErr != nil {
+			return fmt.Errorf("last write failed: %w", s.writeErr)
+		}
+
+		return err
+	}
+
+	// Snapshots are written to a temporary file next to the database and renamed over it
+	probe, err := os.CreateTemp(filepath.Dir(s.path), ".order-api-check-*")
+
+	if err != nil {
+		return err
+	}
+
+	probe.Close()
+
+	if err := os.Remove(probe.Name()); err != nil {
+		return err
+	}
+
+	s.writeErr = nil
+
+	return nil
+}
+
+func (s *JSONFileStore) Describe() StoreInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	journalSize := s.journal.size
+
+	return StoreInfo{Backend: "json", Path: s.path, JournalBytes: &journalSize}
+}
+
+// Writes a fresh snapshot of every order and empties the journal
+func (s *JSONFileStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.journal.compact(func() error {
+		orders, err := s.MemoryStore.List()
+
+		if err != nil {
+			return err
+		}
+
+		started := time.Now()
+		err = saveDatabase(s.path, orders)
+
+		s.observe("snapshot", started, err)
+		s.writeErr = err
+
+		return err
+	})
+}
+
+// Stops background compaction, folds whatever is left in the journal into the snapshot
+// and closes the journal
+func (s *JSONFileStore) Close() error {
+	return s.journal.close(s.compact)
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Schema changes for the SQLite database. Each entry is applied once, in order, and the
+// number applied so far is tracked with PRAGMA user_version. Never edit an entry that has
+// shipped, append a new one instead
+var sqliteMigrations = []string{
+	`CREATE TABLE statuses (
+		name TEXT PRIMARY KEY
+	);
+
+	CREATE TABLE orders (
+		seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+		id        TEXT    NOT NULL UNIQUE,
+		active    BOOLEAN NOT NULL,
+		address   TEXT    NOT NULL,
+		recipient TEXT    NOT NULL,
+		status    TEXT    NOT NULL REFERENCES statuses (name)
+	);
+
+	CREATE TABLE items (
+		order_seq INTEGER NOT NULL REFERENCES orders (seq) ON DELETE CASCADE,
+		position  INTEGER NOT NULL,
+		name      TEXT    NOT NULL,
+		price     REAL    NOT NULL,
+		quantity  INTEGER NOT NULL,
+		PRIMARY KEY (order_seq, position)
+	);`,
+
+	`ALTER TABLE orders ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE orders ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
+
+	CREATE TABLE status_history (
+		order_seq INTEGER NOT NULL REFERENCES orders (seq) ON DELETE CASCADE,
+		position  INTEGER NOT NULL,
+		status    TEXT    NOT NULL REFERENCES statuses (name),
+		timestamp TEXT    NOT NULL,
+		actor     TEXT    NOT NULL DEFAULT '',
+		note      TEXT    NOT NULL DEFAULT '',
+		PRIMARY KEY (order_seq, position)
+	);`,
+
+	// Prices move from floats to integer minor units. Every order saved so far was in dollars
+	`ALTER TABLE orders ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD';
+	ALTER TABLE items ADD COLUMN unit_price INTEGER NOT NULL DEFAULT 0;
+	UPDATE items SET unit_price = CAST(ROUND(price * 100) AS INTEGER);
+	ALTER TABLE items DROP COLUMN price;`,
+
+	`ALTER TABLE orders ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+
+	`ALTER TABLE status_history ADD COLUMN reason TEXT NOT NULL DEFAULT '';`,
+}
+
+// SQLiteStore keeps orders in an embedded SQLite database with the items in their own table
+type SQLiteStore struct {
+	db   *sql.DB
+	path string
+	// Told about every transaction that is committed, may be nil
+	observer WriteObserver
+}
+
+// Opens (or creates) the SQLite database at path and brings its schema up to date
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000")
+
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows a single writer so funnel everything through one connection
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteStore{db: db, path: path}
+
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Applies any migrations the database hasn't seen yet and registers the known statuses
+func (s *SQLiteStore) migrate() error {
+	var version int
+
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, len(sqliteMigrations))
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+
+		// PRAGMA doesn't accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	for _, status := range allStatuses {
+		if _, err := s.db.Exec("INSERT OR IGNORE INTO statuses (name) VALUES (?)", status); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Common interface of *sql.DB and *sql.Tx used by the read helpers
+type sqlQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+const orderColumns = "seq, id, active, address, recipient, status, currency, created_at, updated_at, version"
+
+// Times are stored as RFC 3339 text so the database stays readable, an empty string is the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// Reads every order matching the WHERE clause along with its items and status history
+func queryOrders(q sqlQueryer, where string, args ...any) ([]Order, []int64, error) {
+	rows, err := q.Query("SELECT "+orderColumns+" FROM orders "+where+" ORDER BY seq", args...)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var orders []Order
+	var seqs []int64
+	position := map[int64]int{}
+
+	for rows.Next() {
+		var order Order
+		var seq int64
+		var createdAt, updatedAt string
+
+		err := rows.Scan(&seq, &order.ID, &order.Active, &order.Address, &order.Recipient, &order.OrderStatus, &order.Currency, &createdAt, &updatedAt, &order.Version)
+
+		if err == nil {
+			order.CreatedAt, err = parseTime(createdAt)
+		}
+
+		if err == nil {
+			order.UpdatedAt, err = parseTime(updatedAt)
+		}
+
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+
+		position[seq] = len(orders)
+		orders = append(orders, order)
+		seqs = append(seqs, seq)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(orders) == 0 {
+		return orders, seqs, nil
+	}
+
+	// Select the child rows with the same WHERE clause rather than listing every
+	// sequence number, which could run past SQLite's limit on bound parameters
+	in := "order_seq IN (SELECT seq FROM orders " + where + ")"
+
+	if err := queryItems(q, in, args, orders, position); err != nil {
+		return nil, nil, err
+	}
+
+	if err := queryHistory(q, in, args, orders, position); err != nil {
+		return nil, nil, err
+	}
+
+	for i := range orders {
+		orders[i].computeTotals()
+	}
+
+	return orders, seqs, nil
+}
+
+// Fills in the items of the orders. position maps each sequence number to its index in orders
+func queryItems(q sqlQueryer, in string, args []any, orders []Order, position map[int64]int) error {
+	rows, err := q.Query("SELECT order_seq, name, unit_price, quantity FROM items WHERE "+in+" ORDER BY order_seq, position", args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var seq int64
+		var item Item
+
+		if err := rows.Scan(&seq, &item.Name, &item.UnitPrice, &item.Quantity); err != nil {
+			return err
+		}
+
+		i := position[seq]
+		orders[i].Items = append(orders[i].Items, item)
+	}
+
+	return rows.Err()
+}
+
+// Fills in the status history of the orders. position maps each sequence number to its index in orders
+func queryHistory(q sqlQueryer, in string, args []any, orders []Order, position map[int64]int) error {
+	rows, err := q.Query("SELECT order_seq, status, timestamp, actor, note, reason FROM status_history WHERE "+in+" ORDER BY order_seq, position", args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var seq int64
+		var change StatusChange
+		var timestamp string
+
+		if err := rows.Scan(&seq, &change.Status, &timestamp, &change.Actor, &change.Note, &change.Reason); err != nil {
+			return err
+		}
+
+		if change.Timestamp, err = parseTime(timestamp); err != nil {
+			return err
+		}
+
+		i := position[seq]
+		orders[i].StatusHistory = append(orders[i].StatusHistory, change)
+	}
+
+	return rows.Err()
+}
+
+// Replaces the items stored for an order
+func writeItems(tx *sql.Tx, seq int64, items []Item) error {
+	if _, err := tx.Exec("DELETE FROM items WHERE order_seq = ?", seq); err != nil {
+		return err
+	}
+
+	for i, item := range items {
+		_, err := tx.Exec("INSERT INTO items (order_seq, position, name, unit_price, quantity) VALUES (?, ?, ?, ?, ?)",
+			seq, i, item.Name, item.UnitPrice, item.Quantity)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replaces the status history stored for an order
+func writeHistory(tx *sql.Tx, seq int64, history []StatusChange) error {
+	if _, err := tx.Exec("DELETE FROM status_history WHERE order_seq = ?", seq); err != nil {
+		return err
+	}
+
+	for i, change := range history {
+		_, err := tx.Exec("INSERT INTO status_history (order_seq, position, status, timestamp, actor, note, reason) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			seq, i, change.Status, formatTime(change.Timestamp), change.Actor, change.Note, change.Reason)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) Get(id string) (Order, error) {
+	orders, _, err := queryOrders(s.db, "WHERE id = ?", id)
+
+	if err != nil {
+		return Order{}, err
+	}
+
+	if len(orders) == 0 {
+		return Order{}, ErrOrderNotFound
+	}
+
+	return orders[0], nil
+}
+
+func (s *SQLiteStore) List() ([]Order, error) {
+	orders, _, err := queryOrders(s.db, "")
+
+	return orders, err
+}
+
+func (s *SQLiteStore) Create(order Order) error {
+	started := time.Now()
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := order.computeTotals(); err != nil {
+		return err
+	}
+
+	if order.Version == 0 {
+		order.Version = 1
+	}
+
+	result, err := tx.Exec("INSERT INTO orders (id, active, address, recipient, status, currency, created_at, updated_at, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		order.ID, order.Active, order.Address, order.Recipient, order.OrderStatus, order.Currency, formatTime(order.CreatedAt), formatTime(order.UpdatedAt), order.Version)
+
+	var sqliteErr sqlite3.Error
+
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrOrderExists
+	}
+
+	if err != nil {
+		return err
+	}
+
+	seq, err := result.LastInsertId()
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeItems(tx, seq, order.Items); err != nil {
+		return err
+	}
+
+	if err := writeHistory(tx, seq, order.StatusHistory); err != nil {
+		return err
+	}
+
+	return s.commit(tx, started)
+}
+
+func (s *SQLiteStore) Update(id string, fn func(order *Order) error) (Order, error) {
+	started := time.Now()
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return Order{}, err
+	}
+
+	defer tx.Rollback()
+
+	orders, seqs, err := queryOrders(tx, "WHERE id = ?", id)
+
+	if err != nil {
+		return Order{}, err
+	}
+
+	if len(orders) == 0 {
+		return Order{}, ErrOrderNotFound
+	}
+
+	order := orders[0]
+
+	if err := fn(&order); err != nil {
+		return Order{}, err
+	}
+
+	if err := order.computeTotals(); err != nil {
+		return Order{}, err
+	}
+
+	order.Version++
+
+	_, err = tx.Exec("UPDATE orders SET id = ?, active = ?, address = ?, recipient = ?, status = ?, currency = ?, created_at = ?, updated_at = ?, version = ? WHERE seq = ?",
+		order.ID, order.Active, order.Address, order.Recipient, order.OrderStatus, order.Currency, formatTime(order.CreatedAt), formatTime(order.UpdatedAt), order.Version, seqs[0])
+
+	if err != nil {
+		return Order{}, err
+	}
+
+	if err := writeItems(tx, seqs[0], order.Items); err != nil {
+		return Order{}, err
+	}
+
+	if err := writeHistory(tx, seqs[0], order.StatusHistory); err != nil {
+		return Order{}, err
+	}
+
+	if err := s.commit(tx, started); err != nil {
+		return Order{}, err
+	}
+
+	return order, nil
+}
+
+func (s *SQLiteStore) Delete(id string, check func(order Order) error) (Order, error) {
+	started := time.Now()
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return Order{}, err
+	}
+
+	defer tx.Rollback()
+
+	orders, seqs, err := queryOrders(tx, "WHERE id = ?", id)
+
+	if err != nil {
+		return Order{}, err
+	}
+
+	if len(orders) == 0 {
+		return Order{}, ErrOrderNotFound
+	}
+
+	if check != nil {
+		if err := check(orders[0]); err != nil {
+			return Order{}, err
+		}
+	}
+
+	// Items are removed by the ON DELETE CASCADE
+	if _, err := tx.Exec("DELETE FROM orders WHERE seq = ?", seqs[0]); err != nil {
+		return Order{}, err
+	}
+
+	if err := s.commit(tx, started); err != nil {
+		return Order{}, err
+	}
+
+	return orders[0], nil
+}
+
+// Commits a transaction begun at started and reports it to the observer
+func (s *SQLiteStore) commit(tx *sql.Tx, started time.Time) error {
+	err := tx.Commit()
+
+	if s.observer != nil {
+		s.observer("transaction", time.Since(started), err)
+	}
+
+	return err
+}
+
+// Must be called before the store is shared
+func (s *SQLiteStore) ObserveWrites(observer WriteObserver) {
+	s.observer = observer
+}
+
+func (s *SQLiteStore) Count() (OrderCounts, error) {
+	rows, err := s.db.Query("SELECT status, active, COUNT(*) FROM orders GROUP BY status, active")
+
+	if err != nil {
+		return OrderCounts{}, err
+	}
+
+	defer rows.Close()
+
+	counts := OrderCounts{ByStatus: map[Status]int{}}
+
+	for rows.Next() {
+		var status Status
+		var active bool
+		var n int
+
+		if err := rows.Scan(&status, &active, &n); err != nil {
+			return OrderCounts{}, err
+		}
+
+		counts.Total += n
+		counts.ByStatus[status] += n
+
+		if active {
+			counts.Active += n
+		} else {
+			counts.Inactive += n
+		}
+	}
+
+	return counts, rows.Err()
+}
+
+// Fails if the database can't be reached or has become read only
+func (s *SQLiteStore) Check() error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// Deletes nothing but SQLite still refuses it when the database can't be written to
+	_, err = tx.Exec("DELETE FROM statuses WHERE 0")
+
+	return err
+}
+
+func (s *SQLiteStore) Describe() StoreInfo {
+	return StoreInfo{Backend: "sqlite", Path: s.path}
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
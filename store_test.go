@@ -0,0 +1,742 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// Creates an empty JSON database in a temporary directory and returns its path
+func setupDatabaseFile(tb testing.TB) string {
+	path := filepath.Join(tb.TempDir(), "orders.json")
+
+	err := os.WriteFile(path, []byte("[]"), 0644)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return path
+}
+
+func TestJSONFileStorePersists(t *testing.T) {
+	path := setupDatabaseFile(t)
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	store.Create(exampleOrder())
+
+	second := exampleOrder()
+	second.ID = "2"
+	store.Create(second)
+
+	store.Update("1", func(order *Order) error {
+		order.Address = "240 Park Street"
+		return nil
+	})
+
+	store.Delete("2", nil)
+
+	// Reopen the file to make sure every change made it to disk
+	reopened, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	orders, _ := reopened.List()
+
+	assert.Equal(t, len(orders), 1)
+	assert.Equal(t, orders[0].Address, "240 Park Street")
+}
+
+func TestMemoryStoreUpdateError(t *testing.T) {
+	store := NewMemoryStore(exampleOrder())
+
+	_, err := store.Update("1", func(order *Order) error {
+		order.Address = "240 Park Street"
+		return errOrderInactive
+	})
+
+	order, _ := store.Get("1")
+
+	assert.Equal(t, err, errOrderInactive)
+	assert.Equal(t, order.Address, "123 Example Street")
+}
+
+func TestSQLiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.db")
+
+	store, err := NewSQLiteStore(path)
+
+	if err != nil {
+		panic(err)
+	}
+
+	createdAt := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	order := exampleOrder()
+	order.Items = append(order.Items, Item{Name: "Mouse", UnitPrice: 1950, Quantity: 2})
+	order.CreatedAt = createdAt
+	order.StatusHistory = []StatusChange{{Status: OrderRecieved, Timestamp: createdAt}}
+
+	assert.Equal(t, store.Create(order), nil)
+
+	second := exampleOrder()
+	second.ID = "2"
+	store.Create(second)
+
+	assert.Equal(t, store.Create(second), ErrOrderExists)
+
+	_, err = store.Update("1", func(order *Order) error {
+		order.Items = order.Items[1:]
+
+		return order.transition(StatusChange{Status: OrderProcessing, Timestamp: createdAt.Add(time.Hour), Actor: "warehouse"})
+	})
+
+	assert.Equal(t, err, nil)
+
+	_, err = store.Delete("2", nil)
+
+	assert.Equal(t, err, nil)
+
+	_, err = store.Delete("2", nil)
+
+	assert.Equal(t, err, ErrOrderNotFound)
+
+	store.Close()
+
+	// Reopening runs the migrations again which must be a no-op
+	store, err = NewSQLiteStore(path)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer store.Close()
+
+	orders, err := store.List()
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(orders), 1)
+	assert.Equal(t, orders[0].OrderStatus, OrderProcessing)
+	assert.Equal(t, orders[0].Items, []Item{{Name: "Mouse", UnitPrice: 1950, Quantity: 2, Subtotal: 3900}})
+	assert.Equal(t, orders[0].Total, int64(3900))
+	assert.Equal(t, orders[0].CreatedAt, createdAt)
+	assert.Equal(t, orders[0].UpdatedAt, createdAt.Add(time.Hour))
+	assert.Equal(t, orders[0].StatusHistory, []StatusChange{
+		{Status: OrderRecieved, Timestamp: createdAt},
+		{Status: OrderProcessing, Timestamp: createdAt.Add(time.Hour), Actor: "warehouse"},
+	})
+	cancelledAt := createdAt.Add(2 * time.Hour)
+
+	store.Update("1", func(order *Order) error {
+		return order.transition(StatusChange{Status: OrderCancelled, Timestamp: cancelledAt, Reason: CancelFraudSuspected})
+	})
+
+	cancelled, _ := store.Get("1")
+
+	assert.Equal(t, cancelled.Active, false)
+	assert.Equal(t, cancelled.StatusHistory[2].Reason, CancelFraudSuspected)
+}
+
+func TestJSONFileStoreRecoversTempFile(t *testing.T) {
+	path := setupDatabaseFile(t)
+
+	// Simulate a crash part way through writing the temporary file
+	err := os.WriteFile(tempPath(path), []byte(`[{"id": "1", "act`), 0644)
+
+	if err != nil {
+		panic(err)
+	}
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	orders, _ := store.List()
+
+	_, err = os.Stat(tempPath(path))
+
+	assert.Equal(t, len(orders), 0)
+	assert.Equal(t, os.IsNotExist(err), true)
+
+	// If the database itself is gone the finished temporary file is used instead
+	data, _ := json.Marshal([]Order{exampleOrder()})
+	os.WriteFile(tempPath(path), data, 0644)
+	os.Remove(path)
+
+	store, err = NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	orders, _ = store.List()
+
+	assert.Equal(t, len(orders), 1)
+}
+
+func TestJSONFileStoreWriteError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "orders.json")
+
+	os.WriteFile(path, []byte("[]"), 0644)
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Closing the journal makes every write fail
+	store.journal.file.Close()
+
+	err = store.Create(exampleOrder())
+
+	orders, _ := store.List()
+
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, len(orders), 0)
+}
+
+func TestJSONFileStoreCompaction(t *testing.T) {
+	path := setupDatabaseFile(t)
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	store.Create(exampleOrder())
+
+	// Nothing but the journal is written until a compaction happens
+	data, _ := os.ReadFile(path)
+	info, _ := os.Stat(journalPath(path))
+
+	assert.Equal(t, string(data), "[]")
+	assert.NotEqual(t, info.Size(), int64(0))
+
+	assert.Equal(t, store.compact(), nil)
+
+	var orders []Order
+
+	data, _ = os.ReadFile(path)
+	json.Unmarshal(data, &orders)
+	info, _ = os.Stat(journalPath(path))
+
+	assert.Equal(t, len(orders), 1)
+	assert.Equal(t, info.Size(), int64(0))
+}
+
+func TestJSONFileStoreReplaysJournal(t *testing.T) {
+	path := setupDatabaseFile(t)
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	store.Create(exampleOrder())
+	store.Update("1", func(order *Order) error {
+		order.OrderStatus = OrderProcessing
+		return nil
+	})
+
+	// Simulate a crash part way through appending another entry
+	store.journal.file.Write([]byte(`{"op":"delete","id":"1"`))
+	store.journal.file.Close()
+
+	reopened, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	order, err := reopened.Get("1")
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, order.OrderStatus, OrderProcessing)
+
+	// Closing folds the journal into the database file
+	reopened.Close()
+
+	var orders []Order
+
+	data, _ := os.ReadFile(path)
+	json.Unmarshal(data, &orders)
+
+	assert.Equal(t, len(orders), 1)
+	assert.Equal(t, orders[0].OrderStatus, OrderProcessing)
+}
+
+func TestSQLiteStoreMigratesFloatPrices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.db")
+
+	db, err := sql.Open("sqlite3", path)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Build a database as it was before prices became integers
+	for i, migration := range sqliteMigrations[:2] {
+		db.Exec(migration)
+		db.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+	}
+
+	db.Exec("INSERT INTO statuses (name) VALUES ('OrderRecieved')")
+	db.Exec("INSERT INTO orders (seq, id, active, address, recipient, status) VALUES (1, '1', 1, '123 Example Street', 'John Doe', 'OrderRecieved')")
+	db.Exec("INSERT INTO items (order_seq, position, name, price, quantity) VALUES (1, 0, 'Laptop', 999.99, 2)")
+	db.Close()
+
+	store, err := NewSQLiteStore(path)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer store.Close()
+
+	order, err := store.Get("1")
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, order.Currency, "USD")
+	assert.Equal(t, order.Items[0].UnitPrice, int64(99999))
+	assert.Equal(t, order.Total, int64(199998))
+}
+
+func TestStoreVersions(t *testing.T) {
+	dir := t.TempDir()
+
+	jsonPath := setupDatabaseFile(t)
+	memory := NewMemoryStore()
+
+	open := map[string]func() OrderStore{
+		"memory": func() OrderStore {
+			return memory
+		},
+		"json": func() OrderStore {
+			store, err := NewJSONFileStore(jsonPath, 0)
+
+			if err != nil {
+				panic(err)
+			}
+
+			return store
+		},
+		"sqlite": func() OrderStore {
+			store, err := NewSQLiteStore(filepath.Join(dir, "orders.db"))
+
+			if err != nil {
+				panic(err)
+			}
+
+			return store
+		},
+	}
+
+	for name, open := range open {
+		t.Run(name, func(t *testing.T) {
+			store := open()
+
+			store.Create(exampleOrder())
+
+			created, _ := store.Get("1")
+
+			assert.Equal(t, created.Version, int64(1))
+
+			// Orders moved between stores keep their version
+			moved := exampleOrder()
+			moved.ID = "2"
+			moved.Version = 7
+
+			store.Create(moved)
+
+			stored, _ := store.Get("2")
+
+			assert.Equal(t, stored.Version, int64(7))
+
+			updated, err := store.Update("1", func(order *Order) error {
+				order.Recipient = "Jane Doe"
+				return nil
+			})
+
+			assert.Equal(t, err, nil)
+			assert.Equal(t, updated.Version, int64(2))
+
+			// A failed update doesn't use up a version
+			store.Update("1", func(order *Order) error {
+				return errOrderInactive
+			})
+
+			stored, _ = store.Get("1")
+
+			assert.Equal(t, stored.Version, int64(2))
+
+			// The version survives reopening the store
+			store.Close()
+			store = open()
+
+			stored, _ = store.Get("1")
+
+			assert.Equal(t, stored.Version, int64(2))
+
+			// A failed check leaves the order in place
+			_, err = store.Delete("1", func(order Order) error {
+				return errPreconditionFailed
+			})
+
+			assert.Equal(t, err, errPreconditionFailed)
+
+			_, err = store.Delete("1", nil)
+
+			assert.Equal(t, err, nil)
+
+			store.Close()
+		})
+	}
+}
+
+func TestMemoryStoreIndexes(t *testing.T) {
+	store := NewMemoryStore()
+
+	for i := 0; i < 30; i++ {
+		order := exampleOrder()
+		order.ID = strconv.Itoa(i)
+		order.Recipient = []string{"John Doe", "Jane Doe", "Jean Doe"}[i%3]
+		order.OrderStatus = allStatuses[i%4]
+		order.Active = i%5 != 0
+
+		store.Create(order)
+	}
+
+	// Move orders between every index and remove some so stale entries would show up
+	for i := 0; i < 30; i += 4 {
+		store.Update(strconv.Itoa(i), func(order *Order) error {
+			order.Recipient = "JANE DOE"
+			order.OrderStatus = OrderCancelled
+			order.Active = !order.Active
+			return nil
+		})
+	}
+
+	for i := 0; i < 30; i += 7 {
+		store.Delete(strconv.Itoa(i), nil)
+	}
+
+	active := true
+
+	queries := []OrderQuery{
+		{},
+		{Statuses: []Status{OrderCancelled}},
+		{Statuses: []Status{OrderRecieved, OrderShipped}, Active: &active},
+		{Recipient: "jane doe"},
+		{Recipient: "John Doe", Active: &active},
+		{Recipient: "nobody"},
+	}
+
+	all, _ := store.List()
+
+	for _, q := range queries {
+		var want []string
+
+		for _, order := range all {
+			if q.matches(order) {
+				want = append(want, order.ID)
+			}
+		}
+
+		found, err := store.Find(q)
+
+		var got []string
+
+		for _, order := range found {
+			got = append(got, order.ID)
+		}
+
+		sort.Strings(want)
+		sort.Strings(got)
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, got, want)
+	}
+
+	// Insertion order is kept through updates and deletes
+	assert.Equal(t, all[0].ID, "1")
+	assert.Equal(t, all[len(all)-1].ID, "29")
+}
+
+// Creates a MemoryStore holding n orders spread over every status, with ten orders for each recipient
+func benchmarkStore(n int) *MemoryStore {
+	store := NewMemoryStore()
+
+	for i := 0; i < n; i++ {
+		order := exampleOrder()
+		order.ID = strconv.Itoa(i)
+		order.Recipient = fmt.Sprintf("Customer %d", i/10)
+		order.OrderStatus = allStatuses[i%len(allStatuses)]
+
+		store.Create(order)
+	}
+
+	return store
+}
+
+// Looking up an order by ID should take the same time however many orders there are
+func BenchmarkMemoryStoreGet(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		store := benchmarkStore(n)
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := store.Get(strconv.Itoa(i % n)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryStoreUpdate(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		store := benchmarkStore(n)
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := store.Update(strconv.Itoa(i%n), func(order *Order) error {
+					order.Address = "240 Park Street"
+					return nil
+				})
+
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryStoreCreateDelete(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		store := benchmarkStore(n)
+		order := exampleOrder()
+		order.ID = "new"
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				store.Create(order)
+				store.Delete(order.ID, nil)
+			}
+		})
+	}
+}
+
+// Finding one recipient's orders only touches their orders, not every order in the store
+func BenchmarkMemoryStoreFindRecipient(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		store := benchmarkStore(n)
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				q := OrderQuery{Recipient: fmt.Sprintf("Customer %d", i%(n/10))}
+
+				if _, err := store.Find(q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreCounts(t *testing.T) {
+	json, err := NewJSONFileStore(setupDatabaseFile(t), 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer json.Close()
+
+	sqlite, err := NewSQLiteStore(filepath.Join(t.TempDir(), "orders.db"))
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer sqlite.Close()
+
+	stores := map[string]OrderStore{"memory": NewMemoryStore(), "json": json, "sqlite": sqlite}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for i, status := range []Status{OrderRecieved, OrderRecieved, OrderShipped, OrderCancelled} {
+				order := exampleOrder()
+				order.ID = strconv.Itoa(i)
+				order.OrderStatus = status
+				order.Active = status != OrderCancelled
+
+				assert.Equal(t, store.Create(order), nil)
+			}
+
+			_, err := store.Update("0", func(order *Order) error {
+				order.OrderStatus = OrderProcessing
+				return nil
+			})
+
+			assert.Equal(t, err, nil)
+
+			_, err = store.Delete("2", nil)
+
+			assert.Equal(t, err, nil)
+
+			counts, err := store.(OrderCounter).Count()
+
+			assert.Equal(t, err, nil)
+			assert.Equal(t, counts, OrderCounts{
+				Total:    3,
+				Active:   2,
+				Inactive: 1,
+				ByStatus: map[Status]int{OrderRecieved: 1, OrderProcessing: 1, OrderCancelled: 1},
+			})
+
+			// Counting by listing every order gives the same answer
+			orders, err := store.List()
+
+			assert.Equal(t, err, nil)
+
+			listed, err := countOrders(NewMemoryStore(orders...))
+
+			assert.Equal(t, err, nil)
+			assert.Equal(t, listed, counts)
+
+			assert.Equal(t, checkStore(store), "ok")
+		})
+	}
+}
+
+func TestStoreChecks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "orders.json")
+
+	store, err := NewJSONFileStore(path, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer store.Close()
+
+	assert.Equal(t, store.Check(), nil)
+
+	// A failed write makes the store unready until writing works again
+	store.journal.file.Close()
+
+	assert.NotEqual(t, store.Create(exampleOrder()), nil)
+	assert.NotEqual(t, store.Check(), nil)
+
+	store.journal.file, err = os.OpenFile(journalPath(path), os.O_RDWR|os.O_APPEND, 0644)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, store.Check(), nil)
+
+	// Checking leaves nothing behind in the journal
+	info, err := os.Stat(journalPath(path))
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info.Size(), int64(0))
+	assert.Equal(t, store.Create(exampleOrder()), nil)
+
+	// The database's directory going away makes the store unusable
+	assert.Equal(t, os.RemoveAll(dir), nil)
+	assert.NotEqual(t, store.Check(), nil)
+
+	sqlite, err := NewSQLiteStore(filepath.Join(t.TempDir(), "orders.db"))
+
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, sqlite.Check(), nil)
+
+	sqlite.Close()
+
+	assert.NotEqual(t, sqlite.Check(), nil)
+}
+
+func TestStoreWriteObservers(t *testing.T) {
+	json, err := NewJSONFileStore(setupDatabaseFile(t), 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer json.Close()
+
+	sqlite, err := NewSQLiteStore(filepath.Join(t.TempDir(), "orders.db"))
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer sqlite.Close()
+
+	tests := map[string]struct {
+		store WriteObservable
+		kinds []string
+	}{
+		"json":   {json, []string{"journal", "journal", "journal", "snapshot"}},
+		"sqlite": {sqlite, []string{"transaction", "transaction", "transaction"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var kinds []string
+
+			test.store.ObserveWrites(func(kind string, took time.Duration, err error) {
+				assert.Equal(t, err, nil)
+				kinds = append(kinds, kind)
+			})
+
+			store := test.store.(OrderStore)
+
+			assert.Equal(t, store.Create(exampleOrder()), nil)
+
+			_, err := store.Update("1", func(order *Order) error {
+				order.Address = "456 Example Avenue"
+				return nil
+			})
+
+			assert.Equal(t, err, nil)
+
+			// Writes that fail before reaching the disk aren't reported
+			assert.Equal(t, store.Create(exampleOrder()), ErrOrderExists)
+
+			_, err = store.Delete("1", nil)
+
+			assert.Equal(t, err, nil)
+
+			if json, ok := store.(*JSONFileStore); ok {
+				assert.Equal(t, json.compact(), nil)
+			}
+
+			assert.Equal(t, kinds, test.kinds)
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Name of the service in traces and of the tracer spans are made with
+const (
+	serviceName = "order-api"
+	tracerName  = "example/order-api"
+)
+
+// Trace context is read from and written to W3C traceparent, tracestate and baggage headers
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Creates the tracer provider for the exporter picked in config along with a function
+// that flushes any spans that haven't been exported yet and stops it
+func newTracerProvider(config Config) (trace.TracerProvider, func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var closeOutput func() error
+
+	switch config.TracingExporter {
+	case "none":
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case "otlp":
+		var options []otlptracehttp.Option
+
+		// Without an endpoint the exporter uses the standard OTEL_EXPORTER_OTLP_* variables
+		if config.TracingEndpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.TracingEndpoint))
+		}
+
+		otlp, err := otlptracehttp.New(context.Background(), options...)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		exporter = otlp
+	case "stdout":
+		var output io.Writer = os.Stdout
+
+		if config.TracingFile != "" {
+			file, err := os.OpenFile(config.TracingFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			output = file
+			closeOutput = file.Close
+		}
+
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(output))
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		exporter = stdout
+	default:
+		return nil, nil, fmt.Errorf("unknown tracing exporter '%s'", config.TracingExporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TracingSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+
+	shutdown := func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+
+		if closeOutput != nil {
+			err = errors.Join(err, closeOutput())
+		}
+
+		return err
+	}
+
+	return provider, shutdown, nil
+}
+
+// Starts a span for every request, continuing the trace from the request's headers if it has one
+func (api *API) tracing() gin.HandlerFunc {
+	return otelgin.Middleware(serviceName,
+		otelgin.WithTracerProvider(api.tracerProvider),
+		otelgin.WithPropagators(tracePropagator),
+	)
+}
+
+// Starts a child of the span in ctx using the same tracer provider. Without a span in ctx
+// the new span does nothing
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Ends a span, marking it as failed if err isn't nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Binds a request body inside a span so slow parsing shows up in traces
+func traceBind(c *gin.Context, bind func() error) error {
+	_, span := startSpan(c.Request.Context(), "bind")
+
+	err := bind()
+	endSpan(span, err)
+
+	return err
+}
+
+// Returns the active order store, traced as part of the request in ctx
+func (api *API) orders(ctx context.Context) OrderStore {
+	return traceStore(ctx, "orders", api.store)
+}
+
+// Returns the archive, traced as part of the request in ctx
+func (api *API) archived(ctx context.Context) OrderStore {
+	return traceStore(ctx, "archive", api.archive)
+}
+
+// Wraps a store so each operation is a span under the one in ctx. Stores are returned as
+// they are when there is no trace to add to
+func traceStore(ctx context.Context, name string, store OrderStore) OrderStore {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return store
+	}
+
+	return tracedStore{store: store, ctx: ctx, name: name, backend: describeStore(store).Backend}
+}
+
+// An OrderStore whose operations are recorded as spans
+type tracedStore struct {
+	store   OrderStore
+	ctx     context.Context
+	name    string
+	backend string
+}
+
+// Starts the span of a store operation
+func (s tracedStore) start(op string, id string) trace.Span {
+	attrs := []attribute.KeyValue{
+		attribute.String("order.store", s.name),
+		attribute.String("order.store.backend", s.backend),
+	}
+
+	if id != "" {
+		attrs = append(attrs, attribute.String("order.id", id))
+	}
+
+	_, span := startSpan(s.ctx, "store."+op, attrs...)
+
+	return span
+}
+
+func (s tracedStore) Get(id string) (Order, error) {
+	span := s.start("Get", id)
+
+	order, err := s.store.Get(id)
+	endSpan(span, err)
+
+	return order, err
+}
+
+func (s tracedStore) List() ([]Order, error) {
+	span := s.start("List", "")
+
+	orders, err := s.store.List()
+	span.SetAttributes(attribute.Int("order.count", len(orders)))
+	endSpan(span, err)
+
+	return orders, err
+}
+
+func (s tracedStore) Find(q OrderQuery) ([]Order, error) {
+	span := s.start("Find", "")
+
+	orders, err := findOrders(s.store, q)
+	span.SetAttributes(attribute.Int("order.count", len(orders)))
+	endSpan(span, err)
+
+	return orders, err
+}
+
+func (s tracedStore) Create(order Order) error {
+	span := s.start("Create", order.ID)
+
+	err := s.store.Create(order)
+	endSpan(span, err)
+
+	return err
+}
+
+func (s tracedStore) Update(id string, fn func(order *Order) error) (Order, error) {
+	span := s.start("Update", id)
+
+	order, err := s.store.Update(id, fn)
+	endSpan(span, err)
+
+	return order, err
+}
+
+func (s tracedStore) Delete(id string, check func(order Order) error) (Order, error) {
+	span := s.start("Delete", id)
+
+	order, err := s.store.Delete(id, check)
+	endSpan(span, err)
+
+	return order, err
+}
+
+func (s tracedStore) Close() error {
+	return s.store.Close()
+}
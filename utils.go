@@ -4,58 +4,235 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
 )
 
-// Removes an item from a slice based on an index
-func remove(slice []Order, s int) []Order {
-	return append(slice[:s], slice[s+1:]...)
+// Returns a copy of an order that doesn't share its items with the original
+func cloneOrder(order Order) Order {
+	if order.Items != nil {
+		order.Items = append([]Item(nil), order.Items...)
+	}
+
+	if order.StatusHistory != nil {
+		order.StatusHistory = append([]StatusChange(nil), order.StatusHistory...)
+	}
+
+	return order
 }
 
 // Saves the curent JSON data to the "database" which is just a JSON file
-func saveDatabase(orders []Order) {
+func saveDatabase(path string, orders []Order) error {
 	bytes, err := json.Marshal(orders)
 
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	return writeFileAtomic(path, bytes)
+}
+
+// Returns the name of the temporary file used while path is being rewritten
+func tempPath(path string) string {
+	return path + ".tmp"
+}
+
+// Replaces the contents of path without ever leaving a half written file behind.
+// The data goes to a temporary file which is flushed to disk and then renamed over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp := tempPath(path)
+
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Sync the directory too so the rename itself survives a crash
+	dir, err := os.Open(filepath.Dir(path))
+
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// Cleans up after a crash that happened while the database at path was being written.
+// A leftover temporary file is only used if the database itself is missing or corrupt,
+// otherwise it holds a write that never completed and is thrown away
+func recoverDatabase(path string) error {
+	tmp := tempPath(path)
+
+	tmpData, err := os.ReadFile(tmp)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err == nil && json.Valid(data) {
+		slog.Warn("Discarding incomplete write", "path", tmp)
+		return os.Remove(tmp)
+	}
+
+	if json.Valid(tmpData) {
+		slog.Warn("Restoring interrupted write", "path", path, "from", tmp)
+		return os.Rename(tmp, path)
+	}
+
+	slog.Warn("Discarding corrupt write", "path", tmp)
+
+	return os.Remove(tmp)
+}
+
+// Checks request bodies against the rules in their validate tags
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+
+	// Report fields by the names clients send them as
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+		if name == "-" {
+			return ""
+		}
+
+		return name
+	})
+
+	v.RegisterValidation("status", func(fl validator.FieldLevel) bool {
+		return Status(fl.Field().String()).Valid()
+	})
+
+	v.RegisterValidation("cancelreason", func(fl validator.FieldLevel) bool {
+		return CancelReason(fl.Field().String()).Valid()
+	})
+
+	v.RegisterValidation("orderid", func(fl validator.FieldLevel) bool {
+		return validOrderID(fl.Field().String())
+	})
+
+	return v
+}
+
+// Reports whether a client picked order ID can be used as is in a URL path. Empty IDs are
+// allowed as the server generates one for them
+func validOrderID(id string) bool {
+	if id == "." || id == ".." {
+		return false
 	}
 
-	os.WriteFile("orders.json", bytes, 0644)
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '~', c == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
 }
 
-func ValidateStruct(s interface{}) (err error) {
-	// first make sure that the input is a struct
-	// having any other type, especially a pointer to a struct,
-	// might result in panic
-	structType := reflect.TypeOf(s)
-	if structType.Kind() != reflect.Struct {
-		return errors.New("input param should be a struct")
+// Checks a struct against the rules in its validate tags. Returns FieldErrors listing
+// every field that broke a rule
+func ValidateStruct(s interface{}) error {
+	err := validate.Struct(s)
+
+	var invalid validator.ValidationErrors
+
+	if !errors.As(err, &invalid) {
+		return err
 	}
 
-	// now go one by one through the fields and validate their value
-	structVal := reflect.ValueOf(s)
-	fieldNum := structVal.NumField()
+	fields := make(FieldErrors, 0, len(invalid))
+
+	for _, fieldErr := range invalid {
+		// The namespace starts with the name of the struct, which means nothing to clients
+		_, field, _ := strings.Cut(fieldErr.Namespace(), ".")
 
-	for i := 0; i < fieldNum; i++ {
-		// Field(i) returns i'th value of the struct
-		field := structVal.Field(i)
-		fieldName := structType.Field(i).Name
+		fields = append(fields, FieldError{
+			Field:   field,
+			Rule:    fieldErr.Tag(),
+			Message: validationMessage(fieldErr),
+		})
+	}
+
+	return fields
+}
 
-		// CAREFUL! IsZero interprets empty strings and int equal 0 as a zero value.
-		// To check only if the pointers have been initialized,
-		// you can check the kind of the field:
-		// if field.Kind() == reflect.Pointer { // check }
+// Describes the rule a field broke
+func validationMessage(err validator.FieldError) string {
+	// min and max limit the length of strings and slices rather than their value
+	length := err.Kind() == reflect.String || err.Kind() == reflect.Slice
 
-		// IsZero panics if the value is invalid.
-		// Most functions and methods never return an invalid Value.
-		isSet := field.IsValid() && !field.IsZero()
+	switch err.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		if length {
+			return fmt.Sprintf("length must be at least %s", err.Param())
+		}
 
-		if !isSet {
-			err = errors.New(fmt.Sprintf("%v%s in not set; ", err, fieldName))
+		return fmt.Sprintf("must be at least %s", err.Param())
+	case "max":
+		if length {
+			return fmt.Sprintf("length must be at most %s", err.Param())
 		}
 
+		return fmt.Sprintf("must be at most %s", err.Param())
+	case "gt":
+		return fmt.Sprintf("must be greater than %s", err.Param())
+	case "status":
+		return fmt.Sprintf("must be one of %v", allStatuses)
+	case "cancelreason":
+		return fmt.Sprintf("must be one of %v", cancelReasons)
+	case "orderid":
+		return "may only contain letters, digits, '.', '_', '~' and '-', and can't be '.' or '..'"
+	case "required_if":
+		return "is required when cancelling an order"
+	case "iso4217":
+		return "must be an ISO 4217 currency code"
 	}
 
-	return err
+	return fmt.Sprintf("failed the '%s' rule", err.Tag())
 }